@@ -0,0 +1,114 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// CI systems given with -ci.
+const (
+	ciAuto      = "auto"
+	ciNone      = "none"
+	ciGitHub    = "github"
+	ciGitLab    = "gitlab"
+	ciBuildkite = "buildkite"
+)
+
+// ciMarkers returns the markers of the CI system ci, detected from the
+// environment, read with getenv, if it is auto. It returns nil if parexec is
+// not running in a known CI system.
+func ciMarkers(ci string, getenv func(string) string) (exec.Markers, error) {
+	if ci == ciAuto {
+		switch {
+		case getenv("GITHUB_ACTIONS") == "true":
+			ci = ciGitHub
+		case getenv("GITLAB_CI") == "true":
+			ci = ciGitLab
+		case getenv("BUILDKITE") == "true":
+			ci = ciBuildkite
+		default:
+			ci = ciNone
+		}
+	}
+	switch ci {
+	case ciNone:
+		return nil, nil
+	case ciGitHub:
+		return githubMarkers{}, nil
+	case ciGitLab:
+		return gitlabMarkers{}, nil
+	case ciBuildkite:
+		return buildkiteMarkers{}, nil
+	}
+	return nil, fmt.Errorf("unknown CI system %q, want one of %s, %s, %s, %s or %s",
+		ci, ciAuto, ciGitHub, ciGitLab, ciBuildkite, ciNone)
+}
+
+// failed tells whether a block that ended with status is annotated as a
+// failure.
+func failed(status exec.Status) bool {
+	return status == exec.StatusFailed || status == exec.StatusTimedOut
+}
+
+// githubMarkers are the workflow commands of GitHub Actions.
+type githubMarkers struct{}
+
+var (
+	githubData     = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	githubProperty = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+func (githubMarkers) Start(group string) string {
+	return "::group::" + githubData.Replace(group) + "\n"
+}
+
+func (githubMarkers) End(group string, status exec.Status, desc string) string {
+	s := "::endgroup::\n"
+	if failed(status) {
+		s += "::error title=" + githubProperty.Replace(group) + "::" + githubData.Replace(desc) + "\n"
+	}
+	return s
+}
+
+// gitlabMarkers are the collapsible sections of GitLab CI.
+type gitlabMarkers struct{}
+
+// gitlabSection matches the characters section names cannot have.
+var gitlabSection = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func (gitlabMarkers) Start(group string) string {
+	return fmt.Sprintf("\x1b[0Ksection_start:%d:%s\r\x1b[0K%s\n",
+		time.Now().Unix(), gitlabSection.ReplaceAllString(group, "_"), group)
+}
+
+func (gitlabMarkers) End(group string, status exec.Status, desc string) string {
+	s := fmt.Sprintf("\x1b[0Ksection_end:%d:%s\r\x1b[0K\n",
+		time.Now().Unix(), gitlabSection.ReplaceAllString(group, "_"))
+	if failed(status) {
+		s += fmt.Sprintf("\x1b[31;1m%s: %s\x1b[0m\n", group, desc)
+	}
+	return s
+}
+
+// buildkiteMarkers are the log groups of Buildkite.
+type buildkiteMarkers struct{}
+
+func (buildkiteMarkers) Start(group string) string {
+	return "--- " + group + "\n"
+}
+
+func (buildkiteMarkers) End(group string, status exec.Status, desc string) string {
+	if !failed(status) {
+		return ""
+	}
+	// expands the group of the block so the failure is in sight.
+	return "^^^ +++\n" + group + ": " + desc + "\n"
+}
@@ -0,0 +1,438 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// maxAutoName is the maximum length of a generated function name.
+const maxAutoName = 40
+
+// stdinPrevious is the value of stdin_from reading the output of the previous
+// function.
+const stdinPrevious = "previous"
+
+// Values of on_error.
+const (
+	onErrorStop     = "stop"
+	onErrorContinue = "continue"
+)
+
+// assignNames makes sure every block of the config has a unique name, and
+// every function a name unique within its block, which it is referred to by
+// along with the one of the block, e.g. deploy/build. Blocks without a name
+// are called block-<n> after their position and functions without one get a
+// name derived from their command line. Names given in the config must be
+// unique, generated ones get a numeric suffix if they collide.
+func (f *functionsMeta) assignNames() error {
+	blocks := make(map[string]bool)
+	// where keeps where every block name is first given.
+	where := make(map[string]string)
+	for i := range f.Ex {
+		r := &f.Ex[i]
+		if r.Name == "" {
+			continue
+		}
+		if blocks[r.Name] {
+			return errorAt(r.pos, "duplicate block name %q%s", r.Name, givenAt(where[r.Name]))
+		}
+		blocks[r.Name] = true
+		where[r.Name] = r.pos
+	}
+	for i := range f.Ex {
+		r := &f.Ex[i]
+		funcs := make(map[string]bool)
+		fwhere := make(map[string]string)
+		for j := range r.Funcs {
+			fn := &r.Funcs[j]
+			if fn.Name == "" {
+				continue
+			}
+			if funcs[fn.Name] {
+				return errorAt(fn.pos, "duplicate function name %q in block %s%s", fn.Name, blockRef(r, i), givenAt(fwhere[fn.Name]))
+			}
+			funcs[fn.Name] = true
+			fwhere[fn.Name] = fn.pos
+		}
+		// generated names are assigned once all the explicit ones are
+		// known, so they never take a name the config uses further down.
+		if r.Name == "" {
+			r.Name = uniqueName(fmt.Sprintf("block-%d", i), blocks)
+		}
+		for j := range r.Funcs {
+			fn := &r.Funcs[j]
+			if fn.Name == "" {
+				fn.Name = uniqueName(autoName(fn), funcs)
+			}
+		}
+	}
+	return nil
+}
+
+// blockRef returns how the block r, at position i, is referred to in errors
+// before it is named.
+func blockRef(r *execdataMeta, i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("block-%d", i)
+}
+
+// givenAt returns where a name was first given at pos, for errors about it
+// being given again, or nothing if pos is not known.
+func givenAt(pos string) string {
+	if pos == "" {
+		return ""
+	}
+	return ", first given at " + pos
+}
+
+// checkSinks returns an error if the output sinks of fn are wrong.
+func checkSinks(fn functionMeta) error {
+	if fn.Output == nil {
+		return nil
+	}
+	if fn.Log != "" {
+		return errors.New("log and output cannot be given together")
+	}
+	if len(fn.Output) == 0 {
+		return fmt.Errorf("output has no sinks, use %s to drop it", exec.OutputDiscard)
+	}
+	seen := make(map[string]bool)
+	for _, o := range fn.Output {
+		switch {
+		case o == exec.OutputDiscard && len(fn.Output) > 1:
+			return fmt.Errorf("output %s cannot be given along with other sinks", exec.OutputDiscard)
+		case seen[o]:
+			return fmt.Errorf("output %s given twice", o)
+		case o == exec.OutputConsole, o == exec.OutputFile, o == exec.OutputEvents, o == exec.OutputDiscard:
+		case strings.HasPrefix(o, "http://"), strings.HasPrefix(o, "https://"):
+			if _, err := url.Parse(o); err != nil {
+				return fmt.Errorf("output %v", err)
+			}
+		default:
+			return fmt.Errorf("output %q must be %s, %s, %s, %s or an http or https URL", o,
+				exec.OutputConsole, exec.OutputFile, exec.OutputEvents, exec.OutputDiscard)
+		}
+		seen[o] = true
+	}
+	return nil
+}
+
+// unusedSinks returns a warning for every output sink of the functions that
+// goes nowhere, file without a log directory and events without events.
+func (f *functionsMeta) unusedSinks(logDir, events bool) []string {
+	var warnings []string
+	for _, r := range f.Ex {
+		for _, fn := range r.Funcs {
+			for _, o := range fn.Output {
+				switch {
+				case o == exec.OutputFile && !logDir:
+					warnings = append(warnings, fmt.Sprintf("%s/%s: output %s dropped without -log-dir", r.Name, fn.Name, o))
+				case o == exec.OutputEvents && !events:
+					warnings = append(warnings, fmt.Sprintf("%s/%s: output %s dropped without -output %s", r.Name, fn.Name, o, outputJSONL))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// laterStep returns the step the condition c refers to that is not one of the
+// functions before, if any.
+func laterStep(before []functionMeta, c string) string {
+	for _, m := range stepRef.FindAllStringSubmatch(c, -1) {
+		found := false
+		for _, fn := range before {
+			found = found || fn.Name == m[1]
+		}
+		if !found {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// selectPipeline makes the blocks of the pipeline name the ones to run. With
+// no name the functions of the config are run, which it must have if it
+// defines pipelines.
+func (f *functionsMeta) selectPipeline(name string) error {
+	names := make([]string, 0, len(f.Pipelines))
+	for n := range f.Pipelines {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if name == "" {
+		if len(f.Ex) == 0 && len(f.Pipelines) > 0 {
+			return fmt.Errorf("the config only has pipelines, pick one with run: %s", strings.Join(names, ", "))
+		}
+		return nil
+	}
+	p, ok := f.Pipelines[name]
+	if !ok {
+		return fmt.Errorf("unknown pipeline %q, the config has: %s", name, strings.Join(names, ", "))
+	}
+	f.Ex = p
+	return nil
+}
+
+// validate checks the settings of the config that cannot be checked while
+// decoding, and sets up the rate limiters it defines.
+func (f *functionsMeta) validate() error {
+	if f.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d", f.Concurrency)
+	}
+	f.limiters = make(map[string]*exec.Limiter)
+	for name, spec := range f.RateLimits {
+		l, err := exec.NewLimiter(spec)
+		if err != nil {
+			return fmt.Errorf("ratelimit %s: %v", name, err)
+		}
+		f.limiters[name] = l
+	}
+	blocks := make(map[string]bool)
+	for _, r := range f.Ex {
+		blocks[r.Name] = true
+	}
+	for _, r := range f.Ex {
+		if len(r.Funcs) == 0 {
+			return errorAt(r.pos, "block %s: execdata has no functions", r.Name)
+		}
+		for j, fn := range r.Funcs {
+			switch {
+			case fn.StdinFrom != "" && fn.StdinFrom != stdinPrevious:
+				return errorAt(fn.pos, "function %s: stdin_from must be %s", fn.Name, stdinPrevious)
+			case fn.StdinFrom != "" && j == 0:
+				return errorAt(fn.pos, "function %s: stdin_from %s given to the first function of the block", fn.Name, stdinPrevious)
+			}
+			switch {
+			case fn.Script != "" && (fn.Cmd != "" || fn.Shell):
+				return errorAt(fn.pos, "function %s: script cannot be given along with cmd or shell", fn.Name)
+			case fn.Script == "" && fn.Cmd == "":
+				return errorAt(fn.pos, "function %s: cmd or script is needed", fn.Name)
+			}
+			for _, c := range []string{fn.When, fn.Unless} {
+				if step := laterStep(r.Funcs[:j], c); step != "" {
+					return errorAt(fn.pos, "function %s: condition %q refers to %s, which is not a function before it", fn.Name, c, step)
+				}
+			}
+			if len(fn.RehearseArgs) > 0 && fn.RehearseCmd == "" {
+				return errorAt(fn.pos, "function %s: rehearse_args given without rehearse_cmd", fn.Name)
+			}
+			if fn.RateLimit != "" && f.limiters[fn.RateLimit] == nil {
+				return errorAt(fn.pos, "function %s: unknown ratelimit %q", fn.Name, fn.RateLimit)
+			}
+			switch exec.StderrMode(fn.Stderr) {
+			case "", exec.StderrInterleave, exec.StderrSeparate, exec.StderrDiscard:
+			default:
+				return errorAt(fn.pos, "function %s: stderr must be %s, %s or %s", fn.Name,
+					exec.StderrInterleave, exec.StderrSeparate, exec.StderrDiscard)
+			}
+			switch exec.LogMode(fn.Log) {
+			case "", exec.LogBoth, exec.LogFile, exec.LogConsole:
+			default:
+				return errorAt(fn.pos, "function %s: log must be %s, %s or %s", fn.Name,
+					exec.LogBoth, exec.LogFile, exec.LogConsole)
+			}
+			if err := checkSinks(fn); err != nil {
+				return errorAt(fn.pos, "function %s: %v", fn.Name, err)
+			}
+			if flt := fn.Filter.filter(); flt != nil {
+				if err := flt.Check(); err != nil {
+					return errorAt(fn.pos, "function %s: filter %v", fn.Name, err)
+				}
+			}
+			if fn.Retries < 0 {
+				return errorAt(fn.pos, "function %s: negative retries", fn.Name)
+			}
+			if fn.Jitter < 0 || fn.Jitter > 1 {
+				return errorAt(fn.pos, "function %s: jitter must be between 0 and 1", fn.Name)
+			}
+		}
+		switch r.OnError {
+		case "", onErrorStop, onErrorContinue:
+		default:
+			return errorAt(r.pos, "block %s: on_error must be %s or %s", r.Name, onErrorStop, onErrorContinue)
+		}
+		for _, n := range r.Needs {
+			if !blocks[n] {
+				return errorAt(r.pos, "block %s: needs unknown block %q", r.Name, n)
+			}
+		}
+		for _, e := range r.Expect {
+			if (e.Cmd == "") == (e.Var == "") {
+				return errorAt(r.pos, "block %s: expect needs either cmd or var", r.Name)
+			}
+		}
+		if c := r.Converge; c != nil {
+			if c.Interval <= 0 || c.Deadline <= 0 {
+				return errorAt(r.pos, "block %s: converge needs an interval and a deadline", r.Name)
+			}
+			if c.Jitter < 0 || c.Jitter > 1 {
+				return errorAt(r.pos, "block %s: converge jitter must be between 0 and 1", r.Name)
+			}
+		}
+	}
+	return f.checkCycles()
+}
+
+// checkCycles returns an error naming the blocks of the first dependency
+// cycle found among the needs of the blocks, if any.
+func (f *functionsMeta) checkCycles() error {
+	needs := make(map[string][]string)
+	pos := make(map[string]string)
+	for _, r := range f.Ex {
+		needs[r.Name] = r.Needs
+		pos[r.Name] = r.pos
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					return errorAt(pos[name], "dependency cycle: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, n := range needs[name] {
+			if err := visit(n); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+	for _, r := range f.Ex {
+		if err := visit(r.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rehearse makes the functions that have a rehearsal run it in place of their
+// command or script. As rehearsals are read-only they are run even if their
+// function is destructive, the rest of functions are run as they are.
+func (f *functionsMeta) rehearse() {
+	for i := range f.Ex {
+		for j := range f.Ex[i].Funcs {
+			fn := &f.Ex[i].Funcs[j]
+			if fn.RehearseCmd == "" {
+				continue
+			}
+			fn.Cmd, fn.Args, fn.Script = fn.RehearseCmd, fn.RehearseArgs, ""
+			fn.Destructive, fn.templated = false, false
+		}
+	}
+}
+
+// autoName derives a function name from its command and arguments, or the
+// first line of its script.
+func autoName(fn *functionMeta) string {
+	name := strings.TrimSpace(strings.Join(append([]string{fn.Cmd}, fn.Args...), " "))
+	if fn.Script != "" {
+		name = strings.TrimSpace(strings.SplitN(strings.TrimSpace(fn.Script), "\n", 2)[0])
+	}
+	if len(name) > maxAutoName {
+		// cut on a rune boundary, not within a multibyte rune.
+		n := maxAutoName
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = strings.TrimSpace(name[:n])
+	}
+	return name
+}
+
+// safeMode is why functions marked destructive are not run.
+const safeMode = "blocked by safe mode"
+
+// defaultShell is the shell functions with shell or script run through when
+// the config does not pick one.
+const defaultShell = "/bin/sh"
+
+// commandLine returns the command and arguments that run fn. shell is the
+// shell of the config, fn may override it.
+func (fn *functionMeta) commandLine(shell string) (string, []string) {
+	if fn.ShellPath != "" {
+		shell = fn.ShellPath
+	}
+	if shell == "" {
+		shell = defaultShell
+	}
+	switch {
+	case fn.Script != "":
+		// the first argument after the script is $0, the positional
+		// parameters follow.
+		return shell, append([]string{"-c", fn.Script, fn.Name}, fn.Args...)
+	case fn.Shell:
+		return shell, []string{"-c", strings.Join(append([]string{fn.Cmd}, fn.Args...), " ")}
+	}
+	return fn.Cmd, fn.Args
+}
+
+// uniqueName returns name, or name followed by the first free numeric suffix
+// if it is already in taken. The returned name is added to taken.
+func uniqueName(name string, taken map[string]bool) string {
+	n := name
+	for i := 2; taken[n]; i++ {
+		n = fmt.Sprintf("%s-%d", name, i)
+	}
+	taken[n] = true
+	return n
+}
+
+// duration is a time.Duration that decodes from yaml strings such as 1m30s.
+type duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("negative duration %s", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// blockInfo is descriptive metadata of a block, see exec.Info.
+type blockInfo struct {
+	Owner   string `yaml:"owner,omitempty"`
+	Docs    string `yaml:"docs,omitempty"`
+	Runbook string `yaml:"runbook,omitempty"`
+}
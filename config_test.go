@@ -0,0 +1,70 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCycles(t *testing.T) {
+	tests := []struct {
+		name string
+		// needs are the needs of every block, by name, in order.
+		needs [][2]string
+		err   string
+	}{
+		{
+			name:  "no needs",
+			needs: [][2]string{{"a", ""}, {"b", ""}},
+		},
+		{
+			name:  "chain",
+			needs: [][2]string{{"a", ""}, {"b", "a"}, {"c", "b"}},
+		},
+		{
+			name:  "diamond",
+			needs: [][2]string{{"a", ""}, {"b", "a"}, {"c", "a"}, {"d", "b c"}},
+		},
+		{
+			name:  "unknown needs are not cycles",
+			needs: [][2]string{{"a", "missing"}},
+		},
+		{
+			name:  "needs itself",
+			needs: [][2]string{{"a", "a"}},
+			err:   "dependency cycle: a -> a",
+		},
+		{
+			name:  "cycle",
+			needs: [][2]string{{"a", "c"}, {"b", "a"}, {"c", "b"}},
+			err:   "dependency cycle: a -> c -> b -> a",
+		},
+		{
+			name:  "cycle after a chain",
+			needs: [][2]string{{"a", "b"}, {"b", "c"}, {"c", "b"}},
+			err:   "dependency cycle: b -> c -> b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &functionsMeta{}
+			for _, n := range tt.needs {
+				r := execdataMeta{Name: n[0]}
+				if n[1] != "" {
+					r.Needs = strings.Fields(n[1])
+				}
+				f.Ex = append(f.Ex, r)
+			}
+			err := f.checkCycles()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("checkCycles() = %v, want no error", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("checkCycles() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"sync"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// prompter asks the user on the console what to do with the tasks of a run,
+// reading the answers from the standard input. Blocks already running go on
+// while a question waits for its answer, but only one is asked at a time.
+type prompter struct {
+	mu    sync.Mutex
+	in    *bufio.Reader
+	out   io.Writer
+	abort func(reason string)
+}
+
+func newPrompter(out io.Writer, abort func(reason string)) *prompter {
+	return &prompter{in: bufio.NewReader(os.Stdin), out: out, abort: abort}
+}
+
+// ask writes question until it is answered with one of the letters of
+// answers, which it returns. It returns 0 if there is nothing left to read.
+// The caller holds p.mu.
+func (p *prompter) ask(question, answers string) byte {
+	for {
+		fmt.Fprintf(p.out, "%s ", question)
+		line, err := p.in.ReadString('\n')
+		if a := strings.TrimSpace(line); len(a) == 1 && strings.Contains(answers, a) {
+			return a[0]
+		}
+		if err != nil {
+			return 0
+		}
+	}
+}
+
+// onFailure implements exec.Runner.OnFailure, opening a shell where the
+// failed task ran, with its environment, and then asking whether to retry
+// it, skip the failure or abort the run.
+func (p *prompter) onFailure(t *exec.Task, err error) exec.FailureAction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = defaultShell
+	}
+	fmt.Fprintf(p.out, "%v\nopening %s in the environment of %s, exit it to go on\n", err, shell, t.Name)
+	cmd := osexec.Command(shell)
+	cmd.Dir = t.Dir
+	cmd.Env = t.Env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(p.out, "%s: %v\n", shell, err)
+	}
+	switch p.ask(t.Name+": [r]etry, [s]kip the failure or [a]bort the run?", "rsa") {
+	case 'r':
+		return exec.FailureRetry
+	case 's':
+		return exec.FailureSkip
+	case 'a':
+		p.abort("aborted after " + t.Name + " failed")
+	}
+	// with no one to ask the task stays failed.
+	return exec.FailureFail
+}
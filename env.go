@@ -0,0 +1,181 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// envMeta holds settings of the environment commands run in. They can be
+// given at the top of the config, applying to all the functions, per block
+// and per function.
+type envMeta struct {
+	// TZ sets the timezone, e.g. UTC.
+	TZ string `yaml:"tz,omitempty"`
+	// Locale sets both LANG and LC_ALL, e.g. C.UTF-8.
+	Locale string `yaml:"locale,omitempty"`
+	// Path lists directories prepended to PATH.
+	Path []string `yaml:"path,omitempty"`
+	// Proxy sets the proxy commands use.
+	Proxy *proxyMeta `yaml:"proxy,omitempty"`
+	// Env sets environment variables, e.g. KUBECONFIG.
+	Env map[string]string `yaml:"env,omitempty"`
+	// InheritEnv, true by default, passes the environment of parexec on to
+	// the commands. When false they only get the variables the config sets
+	// and the run id.
+	InheritEnv *bool `yaml:"inherit_env,omitempty"`
+}
+
+// proxyMeta holds the proxy settings of commands. When given, they replace
+// any proxy settings parexec itself runs with, so they never leak into
+// commands that must not use them.
+type proxyMeta struct {
+	HTTP    string `yaml:"http,omitempty"`
+	HTTPS   string `yaml:"https,omitempty"`
+	NoProxy string `yaml:"no_proxy,omitempty"`
+	// Disable runs commands without any proxy.
+	Disable bool `yaml:"disable,omitempty"`
+}
+
+// proxyVars are the environment variables holding proxy settings. Tools
+// disagree on the case, so both are set.
+var proxyVars = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"NO_PROXY", "no_proxy",
+	"ALL_PROXY", "all_proxy",
+}
+
+// merge returns the settings of e overridden by the ones of o. Path entries of
+// o come first and variables of both are set. Proxy settings are replaced as
+// a whole.
+func (e envMeta) merge(o envMeta) envMeta {
+	m := e
+	if o.TZ != "" {
+		m.TZ = o.TZ
+	}
+	if o.Locale != "" {
+		m.Locale = o.Locale
+	}
+	if o.Proxy != nil {
+		m.Proxy = o.Proxy
+	}
+	if o.InheritEnv != nil {
+		m.InheritEnv = o.InheritEnv
+	}
+	if len(o.Env) > 0 {
+		m.Env = make(map[string]string, len(e.Env)+len(o.Env))
+		for k, v := range e.Env {
+			m.Env[k] = v
+		}
+		for k, v := range o.Env {
+			m.Env[k] = v
+		}
+	}
+	m.Path = append(append([]string{}, o.Path...), e.Path...)
+	return m
+}
+
+// environ applies the settings to the environment base, in the form returned
+// by os.Environ, and returns the result. base is not modified.
+func (e envMeta) environ(base []string) []string {
+	env := append([]string{}, base...)
+	if e.InheritEnv != nil && !*e.InheritEnv {
+		env = nil
+		if id := getenv(base, runIDEnv); id != "" {
+			env = setenv(env, runIDEnv, id)
+		}
+	}
+	keys := make([]string, 0, len(e.Env))
+	for k := range e.Env {
+		keys = append(keys, k)
+	}
+	// sorted, so commands get the same environment on every run.
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = setenv(env, k, e.Env[k])
+	}
+	if e.TZ != "" {
+		env = setenv(env, "TZ", e.TZ)
+	}
+	if e.Locale != "" {
+		env = setenv(env, "LANG", e.Locale)
+		env = setenv(env, "LC_ALL", e.Locale)
+	}
+	if len(e.Path) > 0 {
+		path := strings.Join(e.Path, string(os.PathListSeparator))
+		if cur := getenv(env, "PATH"); cur != "" {
+			path += string(os.PathListSeparator) + cur
+		}
+		env = setenv(env, "PATH", path)
+	}
+	if p := e.Proxy; p != nil {
+		for _, k := range proxyVars {
+			env = unsetenv(env, k)
+		}
+		if !p.Disable {
+			for k, v := range map[string]string{"http_proxy": p.HTTP, "https_proxy": p.HTTPS, "no_proxy": p.NoProxy} {
+				if v != "" {
+					env = setenv(env, k, v)
+					env = setenv(env, strings.ToUpper(k), v)
+				}
+			}
+		}
+	}
+	return env
+}
+
+// lookPath looks for the executable cmd in the directories of e.Path. It
+// returns cmd unchanged if it contains a path separator or is not found
+// there, in which case the PATH of parexec itself is searched as usual.
+func (e envMeta) lookPath(cmd string) string {
+	if strings.ContainsRune(cmd, filepath.Separator) {
+		return cmd
+	}
+	for _, dir := range e.Path {
+		p := filepath.Join(dir, cmd)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p
+		}
+	}
+	return cmd
+}
+
+// getenv returns the value of key in env.
+func getenv(env []string, key string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// unsetenv removes key from env.
+func unsetenv(env []string, key string) []string {
+	n := 0
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			env[n] = kv
+			n++
+		}
+	}
+	return env[:n]
+}
+
+// setenv sets key to value in env, replacing any previous value.
+func setenv(env []string, key, value string) []string {
+	kv := key + "=" + value
+	for i := range env {
+		if strings.HasPrefix(env[i], key+"=") {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
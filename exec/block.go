@@ -0,0 +1,724 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// execfunc runs a command and returns its state once it has exited. The state
+// is nil if the command could not be started. The command is killed if ctx is
+// done before it exits.
+type execfunc func(ctx context.Context) (*os.ProcessState, error)
+
+// timeoutError is returned by an execfunc whose command ran out of time.
+type timeoutError struct {
+	name   string
+	reason string
+}
+
+func (e *timeoutError) Error() string {
+	return e.name + ": killed, " + e.reason
+}
+
+// execData encapsulates functions that need to be executed. It can contain an
+// array of functions that execute one after another, i.e second function
+// depends on the outcome of the first to be able to execute.
+type execData struct {
+	name string
+	fs   []execfunc
+	// timeout is the maximum time the block can run, 0 for no limit.
+	timeout time.Duration
+	// converge, if set, makes the block run again until it succeeds.
+	converge *Converge
+	info     Info
+	checks   []Check
+	// tasks holds the figures of every function, updated as they run.
+	tasks []*taskStat
+	// defs holds the task every function runs.
+	defs []*Task
+	// pipes holds the output of the functions read by the next one.
+	pipes []*pipe
+	// templated is set if any function is templated or has conditions, in
+	// which case outputs keeps the output of every function for the
+	// templates of the ones after it. steps holds what the
+	// templates see of the functions that ran in the current attempt, and
+	// truncated the ones whose output did not fit.
+	templated bool
+	outputs   []*stepOutput
+	steps     map[string]interface{}
+	truncated []string
+	// continueOnError runs the remaining functions after one fails.
+	continueOnError bool
+	// needs are the groups that have to succeed before the block starts.
+	needs []string
+	// out is where everything about the block is printed. It is the console,
+	// or buf in grouped mode.
+	out io.Writer
+	buf *bytes.Buffer
+	// enqueued is when the block was put in the dispatch queue.
+	enqueued time.Time
+	// id is the position of the group of the block, and status how the
+	// block ended. They are only used to schedule groups with needs.
+	id     int
+	status Status
+}
+
+func newexecData(name string, out io.Writer, grouped bool) *execData {
+	e := &execData{name: name, out: out}
+	if grouped {
+		e.buf = &bytes.Buffer{}
+		e.out = e.buf
+	}
+	return e
+}
+
+// flush prints to w the output of the block collected in grouped mode as a
+// single chunk.
+func (e *execData) flush(w io.Writer) {
+	if e.buf != nil {
+		w.Write(e.buf.Bytes())
+		e.buf.Reset()
+	}
+}
+
+func (e *execData) add(fs execfunc) {
+	e.fs = append(e.fs, fs)
+}
+
+// newBlock builds the execData block that executes g.
+func (rn *run) newBlock(g *Group) *execData {
+	eData := newexecData(g.Name, rn.out, rn.Grouped)
+	eData.timeout = g.Timeout
+	eData.converge = g.Converge
+	eData.info = g.Info
+	eData.checks = g.Checks
+	eData.continueOnError = g.ContinueOnError
+	eData.needs = g.Needs
+	for _, t := range g.Tasks {
+		eData.templated = eData.templated || t.Templated || t.When != "" || t.Unless != ""
+	}
+	var in *pipe
+	for i, t := range g.Tasks {
+		ts := &taskStat{name: t.Name, cmd: QuoteArgv(append([]string{t.Cmd}, t.Args...))}
+		eData.tasks = append(eData.tasks, ts)
+		eData.defs = append(eData.defs, t)
+		tio := taskIO{out: eData.out, logPath: rn.logPath(g.Name, t), group: g.Name}
+		if i+1 < len(g.Tasks) && g.Tasks[i+1].StdinFromPrevious {
+			tio.pipe = &pipe{}
+			eData.pipes = append(eData.pipes, tio.pipe)
+		}
+		if t.StdinFromPrevious {
+			tio.in = in
+		}
+		in = tio.pipe
+		if eData.templated {
+			tio.keep = &stepOutput{}
+		}
+		eData.outputs = append(eData.outputs, tio.keep)
+		if t.Templated {
+			t := t
+			tio.argv = func() (string, []string, error) { return eData.argv(t) }
+		}
+		eData.add(rn.buildFunc(g.Name+"/"+t.Name, t, ts, tio))
+	}
+	return eData
+}
+
+// runBlock executes the functions of edata and records the outcome in bs. A
+// block that has to converge is run again, waiting longer after each failed
+// attempt, until it succeeds, its deadline would be exceeded or the retry
+// budget of the run is exhausted.
+func (rn *run) runBlock(ctx context.Context, edata *execData, bs *blockStat) {
+	defer func() {
+		for _, p := range edata.pipes {
+			p.close()
+		}
+	}()
+	c := edata.converge
+	var deadline time.Time
+	var interval time.Duration
+	if c != nil {
+		deadline = time.Now().Add(c.Deadline)
+		interval = c.Interval
+	}
+	for {
+		bs.attempts++
+		bs.status = rn.runOnce(ctx, edata, bs)
+		// a skipped block would be skipped again.
+		if c == nil || ctx.Err() != nil || bs.status == StatusSkipped {
+			return
+		}
+		if bs.status == StatusOK {
+			if bs.attempts > 1 {
+				fmt.Fprintf(edata.out, "%s: converged after %d attempts\n", edata.name, bs.attempts)
+			}
+			return
+		}
+		wait := withJitter(interval, c.Jitter)
+		if time.Now().Add(wait).After(deadline) {
+			fmt.Fprintf(edata.out, "%s: did not converge after %d attempts within %v\n",
+				edata.name, bs.attempts, c.Deadline)
+			return
+		}
+		if !rn.retries.take() {
+			fmt.Fprintf(edata.out, "%s: did not converge after %d attempts, retry budget exhausted\n",
+				edata.name, bs.attempts)
+			return
+		}
+		fmt.Fprintf(edata.out, "%s: attempt %d %s, retrying in %v\n",
+			edata.name, bs.attempts, bs.status, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			bs.status = StatusCancelled
+			bs.reason = cancelReason(ctx)
+			return
+		}
+		interval *= 2
+		if c.MaxInterval > 0 && interval > c.MaxInterval {
+			interval = c.MaxInterval
+		}
+	}
+}
+
+// runOnce executes the functions of edata one after the other and returns the
+// status of the block. Once a function fails the rest are skipped unless the
+// block continues on error. The block timeout applies to each attempt.
+func (rn *run) runOnce(ctx context.Context, edata *execData, bs *blockStat) Status {
+	bctx, cancel := ctx, context.CancelFunc(func() {})
+	if edata.timeout > 0 {
+		bctx, cancel = WithTimeoutReason(ctx, edata.timeout,
+			fmt.Sprintf("block timeout of %v exceeded", edata.timeout))
+	}
+	defer cancel()
+	for _, ts := range edata.tasks {
+		*ts = taskStat{name: ts.name, cmd: ts.cmd, status: StatusNotStarted, exit: -1}
+	}
+	if edata.templated {
+		edata.steps, edata.truncated = make(map[string]interface{}), nil
+	}
+	if !rn.check(bctx, edata, bs) {
+		if ctx.Err() != nil {
+			bs.reason = cancelReason(ctx)
+			return StatusCancelled
+		}
+		return StatusFailed
+	}
+	status := StatusOK
+	// unmet counts the functions skipped because of their conditions, which
+	// leave the block ok unless none ran.
+	unmet := 0
+	for i, f := range edata.fs {
+		if bctx.Err() != nil {
+			break
+		}
+		if reason := edata.defs[i].Blocked; reason != "" {
+			fmt.Fprintf(edata.out, "%s/%s: %s\n", edata.name, edata.tasks[i].name, reason)
+			if i < len(edata.fs)-1 {
+				fmt.Fprintf(edata.out, "%s: remaining functions skipped\n", edata.name)
+			}
+			bs.reason = reason
+			edata.tasks[i].status = StatusSkipped
+			edata.tasks[i].reason = reason
+			if status == StatusOK {
+				status = StatusSkipped
+			}
+			return status
+		}
+		ts := edata.tasks[i]
+		run, reason, err := edata.condition(edata.defs[i])
+		if err != nil {
+			fmt.Fprintf(edata.out, "%s/%s: %v\n", edata.name, ts.name, err)
+			ts.status = StatusFailed
+			edata.record(ts, nil)
+			status = StatusFailed
+			if !edata.continueOnError {
+				if i < len(edata.fs)-1 {
+					fmt.Fprintf(edata.out, "%s: remaining functions skipped\n", edata.name)
+				}
+				break
+			}
+			continue
+		}
+		if !run {
+			fmt.Fprintf(edata.out, "%s/%s: %s\n", edata.name, ts.name, reason)
+			ts.status, ts.reason = StatusSkipped, reason
+			edata.record(ts, nil)
+			unmet++
+			continue
+		}
+		if rn.Step != nil && !rn.Step(edata.name, edata.resolved(edata.defs[i])) {
+			if bctx.Err() != nil {
+				break
+			}
+			fmt.Fprintf(edata.out, "%s/%s: %s\n", edata.name, ts.name, stepSkipped)
+			ts.status, ts.reason = StatusSkipped, stepSkipped
+			edata.record(ts, nil)
+			if status == StatusOK {
+				status = StatusSkipped
+			}
+			continue
+		}
+		start := time.Now()
+		rn.event(Event{Type: EventStart, Time: start, Group: edata.name, Task: ts.name})
+		ps, err := rn.call(bctx, f, edata.defs[i], edata.name+"/"+ts.name, edata.out)
+		ts.took = time.Since(start)
+		if ps != nil {
+			ts.exit = ps.ExitCode()
+		}
+		bs.usage.add(ts.usage)
+		_, timedOut := err.(*timeoutError)
+		switch {
+		case err == nil:
+			ts.status = StatusOK
+		case timedOut:
+			ts.status = StatusTimedOut
+		case ctx.Err() != nil:
+			ts.status = StatusCancelled
+		case bctx.Err() != nil:
+			ts.status = StatusTimedOut
+		default:
+			ts.status = StatusFailed
+		}
+		edata.record(ts, edata.outputs[i])
+		res := ts.result(edata.name)
+		rn.event(Event{Type: EventFinish, Time: time.Now(), Group: edata.name, Task: ts.name, Result: &res})
+		if err != nil {
+			fmt.Fprintln(edata.out, err)
+			status = StatusFailed
+		}
+		if te, ok := err.(*timeoutError); ok {
+			// later functions depend on this one, which did not
+			// finish.
+			fmt.Fprintf(edata.out, "%s: %s, remaining functions skipped\n", edata.name, te.reason)
+			bs.reason = te.reason
+			return StatusTimedOut
+		}
+		if err != nil && !edata.continueOnError {
+			if i < len(edata.fs)-1 {
+				fmt.Fprintf(edata.out, "%s: remaining functions skipped\n", edata.name)
+			}
+			break
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		status = StatusCancelled
+		bs.reason = cancelReason(ctx)
+	case bctx.Err() != nil:
+		status = StatusTimedOut
+		bs.reason = cancelReason(bctx)
+		fmt.Fprintf(edata.out, "%s: %s, remaining functions skipped\n", edata.name, bs.reason)
+	case status == StatusSkipped:
+		bs.reason = stepSkipped
+	case status == StatusOK && unmet > 0 && unmet == len(edata.fs):
+		status = StatusSkipped
+		bs.reason = "the conditions of every function are unmet"
+	default:
+		bs.reason = ""
+	}
+	return status
+}
+
+// watch stops the processes of cmd once ctx is done, unless exited is closed
+// first. They are asked to exit and killed if they have not after the grace
+// period, or as soon as the runner is killed.
+func (rn *run) watch(ctx context.Context, cmd *osexec.Cmd, exited <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-exited:
+		return
+	}
+	terminate(cmd)
+	grace := time.NewTimer(rn.KillGrace)
+	defer grace.Stop()
+	select {
+	case <-grace.C:
+	case <-rn.killed():
+	case <-exited:
+		return
+	}
+	kill(cmd)
+}
+
+// logPath returns the path of the log file of task t of group, empty if it is
+// not logged.
+func (rn *run) logPath(group string, t *Task) string {
+	if _, file, _, _ := t.sinks(); rn.LogDir == "" || !file {
+		return ""
+	}
+	return filepath.Join(rn.LogDir, logName(group), logName(t.Name)+".log")
+}
+
+// logName returns name with the characters that cannot be part of a file name
+// replaced.
+func logName(name string) string {
+	if name == "." || name == ".." {
+		return strings.Repeat("_", len(name))
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', 0:
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// openLog opens the log file at path with flag, creating its directory.
+func openLog(path string, flag int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flag, 0644)
+}
+
+// stepSkipped is why a task not run at the step prompt was skipped.
+const stepSkipped = "skipped at the step prompt"
+
+// call runs f, which executes t, and lets OnFailure decide what to do if it
+// fails. name identifies the task in messages written to out.
+func (rn *run) call(ctx context.Context, f execfunc, t *Task, name string, out io.Writer) (*os.ProcessState, error) {
+	for {
+		ps, err := f(ctx)
+		// once ctx is done there is nothing left to decide.
+		if err == nil || rn.OnFailure == nil || ctx.Err() != nil {
+			return ps, err
+		}
+		switch rn.OnFailure(t, err) {
+		case FailureRetry:
+			fmt.Fprintf(out, "%s: retrying\n", name)
+			continue
+		case FailureSkip:
+			fmt.Fprintf(out, "%s: failure skipped\n", name)
+			return ps, nil
+		}
+		return ps, err
+	}
+}
+
+// event reports e if the runner wants events.
+func (rn *run) event(e Event) {
+	if rn.Events != nil {
+		rn.Events(e)
+	}
+}
+
+// taskIO is where the command of a task reads from and writes to.
+type taskIO struct {
+	// out is where the output of the command goes, unless pipe is set, in
+	// which case it goes there.
+	out  io.Writer
+	pipe *pipe
+	// logPath, if set, is the log file of the command.
+	logPath string
+	// in is what the command reads, the standard input is empty if nil.
+	in *pipe
+	// keep, if set, keeps the output of the command for templates.
+	keep *stepOutput
+	// argv, if set, returns the command line to run in place of the one of
+	// the task.
+	argv func() (string, []string, error)
+	// group is the name of the group of the task, for its events.
+	group string
+}
+
+// buildFunc builds a new execfunc running t. name identifies the task in
+// messages, tio says where its command reads from and writes to, and the
+// output of the command is counted in ts. A failed command is run again as
+// many times as t.Retries allows.
+func (rn *run) buildFunc(name string, t *Task, ts *taskStat, tio taskIO) execfunc {
+	out, logPath, in, capture := tio.out, tio.logPath, tio.in, tio.pipe
+	console, _, events, remotes := t.sinks()
+	events = events && rn.Events != nil
+	var filter *lineFilter
+	var filterErr error
+	if t.Filter != nil {
+		filter, filterErr = t.Filter.compile()
+	}
+	maxLines := rn.MaxLinesPerSec
+	if t.MaxLinesPerSec > 0 {
+		maxLines = t.MaxLinesPerSec
+	}
+	hexdump := rn.HexDump
+	// the log is truncated by the first attempt of the run, the rest
+	// append to it.
+	logFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	attempt := func(ctx context.Context) (*os.ProcessState, error) {
+		if err := t.Limiter.wait(ctx); err != nil {
+			return nil, fmt.Errorf("%s: not started, %s", name, cancelReason(ctx))
+		}
+		if filterErr != nil {
+			return nil, fmt.Errorf("%s: filter %v", name, filterErr)
+		}
+		if tio.keep != nil {
+			tio.keep.reset()
+		}
+		path, args := t.Cmd, t.Args
+		if tio.argv != nil {
+			var err error
+			if path, args, err = tio.argv(); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			ts.cmd = QuoteArgv(append([]string{path}, args...))
+		}
+		fmt.Fprintf(out, "executing %v\n", path)
+		var lf io.Writer
+		if logPath != "" {
+			f, err := openLog(logPath, logFlags)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			defer f.Close()
+			logFlags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+			fmt.Fprintf(f, "# %s run %s executing %s\n", time.Now().Format(time.RFC3339), rn.RunID, QuoteArgv(append([]string{path}, args...)))
+			// both streams are logged at the same time.
+			lf = &syncWriter{w: f}
+		}
+		tctx := ctx
+		if t.Timeout > 0 {
+			var cancel context.CancelFunc
+			tctx, cancel = WithTimeoutReason(ctx, t.Timeout,
+				fmt.Sprintf("timeout of %v exceeded", t.Timeout))
+			defer cancel()
+		}
+		lookup := path
+		if p, ok := lookEnvPath(path, t.Env); ok {
+			lookup = p
+		}
+		cmd := osexec.Command(lookup, args...)
+		cmd.Env = t.Env
+		cmd.Dir = t.Dir
+		setProcessGroup(cmd)
+		if lookup == "" {
+			err := diagnose(name, cmd, &osexec.Error{Name: path, Err: osexec.ErrNotFound})
+			ts.startErr = err.(*startError).kind
+			return nil, err
+		}
+		if in != nil {
+			cmd.Stdin = in.reader()
+		}
+		var pf io.Writer
+		if capture != nil {
+			f, err := capture.reset()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			pf = f
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		var stderr io.ReadCloser
+		if t.Stderr != StderrDiscard {
+			if stderr, err = cmd.StderrPipe(); err != nil {
+				return nil, err
+			}
+		}
+		if err := cmd.Start(); err != nil {
+			err = diagnose(name, cmd, err)
+			ts.startErr = err.(*startError).kind
+			return nil, err
+		}
+		ts.ran = true
+		exited := make(chan struct{})
+		defer close(exited)
+		go rn.watch(tctx, cmd, exited)
+		// output is forwarded while the command runs instead of being kept
+		// in memory until it exits.
+		w := out
+		if rn.Prefix {
+			w = &prefixer{w: out, prefix: name + " | "}
+		}
+		lw := w
+		var th *throttle
+		if maxLines > 0 {
+			th = &throttle{w: lw, name: name, max: maxLines}
+			w = th
+		}
+		// filtered lines do not count against the throttle.
+		var fw, efw *filterWriter
+		if filter != nil {
+			fw = &filterWriter{f: filter, w: w, name: name}
+			efw = &filterWriter{f: filter, w: lw, name: name + " stderr"}
+			w = fw
+		}
+		g := &binaryGuard{w: w}
+		var outEvents, errEvents io.Writer
+		if events {
+			outEvents = &eventWriter{rn: rn, group: tio.group, task: t.Name, stream: "stdout"}
+			errEvents = &eventWriter{rn: rn, group: tio.group, task: t.Name, stream: "stderr"}
+		}
+		var shippers []*shipper
+		for _, u := range remotes {
+			shippers = append(shippers, ship(ctx, u, rn.RunID, name))
+		}
+		shipped := func(sinks []io.Writer) []io.Writer {
+			for _, s := range shippers {
+				sinks = append(sinks, s)
+			}
+			return sinks
+		}
+		// both streams are read at the same time, otherwise a command
+		// filling the pipe of one would block before closing the other.
+		var c, ce counter
+		var et tail
+		ebuf := &tailBuffer{b: getBuffer()}
+		defer putBuffer(ebuf.b)
+		edone := make(chan struct{})
+		sink := io.Writer(g)
+		if stderr == nil {
+			close(edone)
+		} else {
+			esink := io.Writer(ebuf)
+			if t.Stderr != StderrSeparate {
+				// lines of either stream reach the guard whole and one
+				// at a time.
+				sink = &syncWriter{w: g}
+				esink = sink
+			}
+			esinks := []io.Writer{&ce, &et}
+			if console || lf == nil && t.Output == nil {
+				esinks = append(esinks, esink)
+			}
+			if lf != nil {
+				esinks = append(esinks, lf)
+			}
+			if errEvents != nil {
+				esinks = append(esinks, errEvents)
+			}
+			esinks = shipped(esinks)
+			go func() {
+				stream(stderr, esinks...)
+				close(edone)
+			}()
+		}
+		sinks := []io.Writer{&c}
+		if tio.keep != nil {
+			sinks = append(sinks, tio.keep)
+		}
+		switch {
+		case pf != nil:
+			sinks = append(sinks, pf)
+		case console || lf == nil && t.Output == nil:
+			sinks = append(sinks, sink)
+		}
+		if lf != nil {
+			sinks = append(sinks, lf)
+		}
+		if outEvents != nil {
+			sinks = append(sinks, outEvents)
+		}
+		serr := stream(stdout, shipped(sinks)...)
+		<-edone
+		for _, s := range shippers {
+			// shipping is best effort, the command does not fail because
+			// of it.
+			if err := s.close(); err != nil {
+				fmt.Fprintf(out, "%s: shipping output to %s: %v\n", name, s.url, err)
+			}
+		}
+		ts.bytes, ts.lines = c.count()
+		ts.errBytes, ts.errLines = ce.count()
+		ts.errTail = string(et.b)
+		if th != nil {
+			th.flush()
+		}
+		if fw != nil {
+			fw.report(out)
+		}
+		g.report(out, name, hexdump)
+		ebuf.trim()
+		if ebuf.b.Len() > 0 {
+			if ebuf.dropped > 0 {
+				fmt.Fprintf(out, "%s: stderr, truncated to the last %s (%s dropped):\n", name, formatBytes(int64(ebuf.b.Len())), formatBytes(ebuf.dropped))
+			} else {
+				fmt.Fprintf(out, "%s: stderr:\n", name)
+			}
+			eg := &binaryGuard{w: lw}
+			if efw != nil {
+				eg.w = efw
+			}
+			stream(ebuf.b, eg)
+			if efw != nil {
+				efw.report(out)
+			}
+			eg.report(out, name+" stderr", hexdump)
+		}
+		err = cmd.Wait()
+		ts.usage.add(usageOf(cmd.ProcessState))
+		if lf != nil {
+			fmt.Fprintf(lf, "# %s %v\n", time.Now().Format(time.RFC3339), cmd.ProcessState)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// the command was killed because the context was
+				// cancelled, the reason says more than "signal: killed".
+				return cmd.ProcessState, fmt.Errorf("%s: killed, %s", name, cancelReason(ctx))
+			}
+			if tctx.Err() != nil {
+				return cmd.ProcessState, &timeoutError{name: name, reason: cancelReason(tctx)}
+			}
+			if line := et.lastLine(); line != "" {
+				return cmd.ProcessState, fmt.Errorf("%s: %v: %s", name, err, line)
+			}
+			return cmd.ProcessState, fmt.Errorf("%s: %v", name, err)
+		}
+		return cmd.ProcessState, serr
+	}
+	if t.Retries <= 0 {
+		return attempt
+	}
+	return func(ctx context.Context) (*os.ProcessState, error) {
+		backoff := t.Backoff
+		for i := 1; ; i++ {
+			ps, err := attempt(ctx)
+			if err == nil || i > t.Retries || ctx.Err() != nil {
+				return ps, err
+			}
+			if !rn.retries.take() {
+				fmt.Fprintf(out, "%s: not retried, retry budget exhausted\n", name)
+				return ps, err
+			}
+			wait := withJitter(backoff, t.Jitter)
+			fmt.Fprintf(out, "%v, retry %d of %d in %v\n", err, i, t.Retries, wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ps, err
+			}
+			backoff *= 2
+			if t.MaxBackoff > 0 && backoff > t.MaxBackoff {
+				backoff = t.MaxBackoff
+			}
+		}
+	}
+}
+
+// QuoteArgv returns argv as it would be typed in a shell, quoting the
+// arguments that need it. Control characters are escaped, so the result
+// always fits in a single line.
+func QuoteArgv(argv []string) string {
+	q := make([]string, len(argv))
+	for i, a := range argv {
+		q[i] = a
+		if a == "" || strings.ContainsAny(a, " \t\n\"'\\$`*?[]{}()<>|&;#~") || strings.IndexFunc(a, unicode.IsControl) >= 0 {
+			q[i] = strconv.Quote(a)
+		}
+	}
+	return strings.Join(q, " ")
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type causeKey struct{}
+
+// cause records why a context was cancelled. Causes of nested contexts are
+// chained, the reason of a cancelled context is the one of its outermost
+// cancelled ancestor, as that is what triggered the cancellation of the
+// inner ones.
+type cause struct {
+	ctx    context.Context
+	parent *cause
+
+	mu     sync.Mutex
+	reason string
+}
+
+func (c *cause) set(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+func (c *cause) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+func withCause(ctx context.Context, reason string) (context.Context, *cause) {
+	parent, _ := ctx.Value(causeKey{}).(*cause)
+	c := &cause{parent: parent, reason: reason}
+	c.ctx = context.WithValue(ctx, causeKey{}, c)
+	return c.ctx, c
+}
+
+// WithCancelReason returns a copy of parent that is cancelled by calling the
+// returned function with the reason for it. The reason is reported for the
+// groups and commands the cancellation stops.
+func WithCancelReason(parent context.Context) (context.Context, func(reason string)) {
+	ctx, cancel := context.WithCancel(parent)
+	ctx, c := withCause(ctx, "")
+	return ctx, func(reason string) {
+		c.set(reason)
+		cancel()
+	}
+}
+
+// WithTimeoutReason is like context.WithTimeout, reporting reason for the
+// groups and commands stopped when the timeout expires.
+func WithTimeoutReason(parent context.Context, d time.Duration, reason string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, d)
+	ctx, _ = withCause(ctx, reason)
+	return ctx, cancel
+}
+
+// cancelReason returns why ctx was cancelled, or an empty string if it was not
+// or the reason is unknown.
+func cancelReason(ctx context.Context) string {
+	if ctx.Err() == nil {
+		return ""
+	}
+	reason := ctx.Err().Error()
+	for c, _ := ctx.Value(causeKey{}).(*cause); c != nil; c = c.parent {
+		if c.ctx.Err() != nil {
+			if r := c.get(); r != "" {
+				reason = r
+			}
+		}
+	}
+	return reason
+}
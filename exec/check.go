@@ -0,0 +1,119 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	osexec "os/exec"
+	"strings"
+	"time"
+)
+
+// checkTimeout limits the time the command of a check runs. Checks query the
+// environment and should answer at once, one that hangs must not keep its
+// group from failing.
+const checkTimeout = 30 * time.Second
+
+// Check is something a group expects of the environment it runs in, e.g. the
+// context kubectl uses, verified right before the group starts. A group whose
+// checks fail is not run.
+type Check struct {
+	// Name describes what is checked.
+	Name string
+	// Cmd and Args, if set, are run with Env and their standard output,
+	// trimmed, is the value checked. Got is the value otherwise.
+	Cmd  string
+	Args []string
+	Env  []string
+	Got  string
+	// Want is the value expected.
+	Want string
+}
+
+// CheckResult is the outcome of a check of a group in its last attempt.
+type CheckResult struct {
+	Group string `json:"group"`
+	Check string `json:"check"`
+	Want  string `json:"want"`
+	Got   string `json:"got"`
+	OK    bool   `json:"ok"`
+	// Error tells why the command of the check failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// run returns the outcome of c, which belongs to group. Its command is
+// stopped along with the processes it started, as the ones of tasks are, when
+// ctx is done or it runs longer than checkTimeout.
+func (c *Check) run(ctx context.Context, rn *run, group string) CheckResult {
+	r := CheckResult{Group: group, Check: c.Name, Want: c.Want, Got: c.Got}
+	if c.Cmd != "" {
+		cctx, cancel := WithTimeoutReason(ctx, checkTimeout,
+			fmt.Sprintf("check timeout of %v exceeded", checkTimeout))
+		defer cancel()
+		path := c.Cmd
+		if p, ok := lookEnvPath(c.Cmd, c.Env); ok {
+			path = p
+		}
+		cmd := osexec.Command(path, c.Args...)
+		cmd.Env = c.Env
+		setProcessGroup(cmd)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		var err error
+		if path == "" {
+			err = &osexec.Error{Name: c.Cmd, Err: osexec.ErrNotFound}
+		} else {
+			err = cmd.Start()
+		}
+		if err == nil {
+			exited := make(chan struct{})
+			go rn.watch(cctx, cmd, exited)
+			err = cmd.Wait()
+			close(exited)
+		}
+		r.Got = strings.TrimSpace(stdout.String())
+		if err != nil {
+			r.Error = err.Error()
+			if reason := cancelReason(cctx); reason != "" {
+				r.Error = "killed, " + reason
+			}
+			if line := strings.TrimSpace(stderr.String()); line != "" {
+				r.Error += ": " + line
+			}
+			return r
+		}
+	}
+	r.OK = r.Got == r.Want
+	return r
+}
+
+// check verifies the checks of edata, records their outcome in bs and
+// returns whether they all passed. The ones that did not are reported as a
+// diff of what was expected and what was found.
+func (rn *run) check(ctx context.Context, edata *execData, bs *blockStat) bool {
+	bs.checks = nil
+	var failed []string
+	for i := range edata.checks {
+		r := edata.checks[i].run(ctx, rn, edata.name)
+		bs.checks = append(bs.checks, r)
+		if r.OK {
+			continue
+		}
+		failed = append(failed, r.Check)
+		if r.Error != "" {
+			fmt.Fprintf(edata.out, "%s: check %s failed: %s\n", edata.name, r.Check, r.Error)
+			continue
+		}
+		fmt.Fprintf(edata.out, "%s: check %s failed (-want +got):\n  -%s\n  +%s\n", edata.name, r.Check, r.Want, r.Got)
+	}
+	if len(failed) > 0 {
+		bs.reason = "checks failed: " + strings.Join(failed, ", ")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// hasNeeds tells whether any of groups needs another one. Groups that do not
+// implement GroupDeps are built to find out.
+func hasNeeds(groups Groups) bool {
+	deps, ok := groups.(GroupDeps)
+	for i := 0; i < groups.Len(); i++ {
+		var needs []string
+		if ok {
+			needs = deps.GroupNeeds(i)
+		} else {
+			needs = groups.Group(i).Needs
+		}
+		if len(needs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notStarted returns the figures of the group i of groups, which was not
+// started because of reason. The group is not built if groups implement
+// GroupDeps.
+func notStarted(groups Groups, i int, reason string) blockStat {
+	bs := blockStat{status: StatusNotStarted, reason: reason}
+	if deps, ok := groups.(GroupDeps); ok {
+		bs.name, bs.info = deps.GroupName(i), deps.GroupInfo(i)
+	} else {
+		g := groups.Group(i)
+		bs.name, bs.info = g.Name, g.Info
+	}
+	return bs
+}
+
+// finish hands edata, which ended with status, back to the dispatcher when
+// groups are scheduled by their needs.
+func (rn *run) finish(edata *execData, status Status) {
+	if rn.finished != nil {
+		edata.status = status
+		rn.finished <- edata
+	}
+}
+
+// dispatchDAG sends the groups to the workers through edCh as soon as the
+// groups they need have succeeded. Groups whose needs fail, are unknown or
+// depend on each other in a cycle are recorded as not started, as are the
+// ones left once ctx is done.
+func (rn *run) dispatchDAG(ctx context.Context, groups Groups, edCh chan<- []*execData) {
+	batch := rn.Batch
+	if batch < 1 {
+		batch = 1
+	}
+	n := groups.Len()
+	// blocks are built once they are dispatched or recorded, unless their
+	// names and needs are only known by building them.
+	blocks := make([]*execData, n)
+	block := func(i int) *execData {
+		if blocks[i] == nil {
+			blocks[i] = rn.newBlock(groups.Group(i))
+			blocks[i].id = i
+		}
+		return blocks[i]
+	}
+	names := make([]string, n)
+	needs := make([][]string, n)
+	deps, lazy := groups.(GroupDeps)
+	for i := 0; i < n; i++ {
+		if lazy {
+			names[i], needs[i] = deps.GroupName(i), deps.GroupNeeds(i)
+			continue
+		}
+		g := groups.Group(i)
+		blocks[i] = rn.newBlock(g)
+		blocks[i].id = i
+		names[i], needs[i] = g.Name, g.Needs
+	}
+	byName := make(map[string]int, n)
+	for i, name := range names {
+		byName[name] = i
+	}
+	// pending counts the needs of every block that have not succeeded yet,
+	// dependents lists the blocks that need each one.
+	pending := make([]int, n)
+	dependents := make([][]int, n)
+	recorded := make([]bool, n)
+	// record records the block i as not started, only building it if it
+	// is not built already and groups do not tell what it is without it.
+	record := func(i int, reason string) {
+		recorded[i] = true
+		if ed := blocks[i]; ed != nil {
+			rn.stats.block(blockStat{name: ed.name, info: ed.info, status: StatusNotStarted, reason: reason})
+			return
+		}
+		rn.stats.block(notStarted(groups, i, reason))
+	}
+	var skip func(i int, reason string)
+	skip = func(i int, reason string) {
+		if recorded[i] {
+			return
+		}
+		record(i, reason)
+		for _, d := range dependents[i] {
+			skip(d, fmt.Sprintf("needs %s, which was not started", names[i]))
+		}
+	}
+	unknown := make(map[int]string)
+	for i := 0; i < n; i++ {
+		for _, name := range needs[i] {
+			j, ok := byName[name]
+			if !ok {
+				unknown[i] = name
+				continue
+			}
+			pending[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	for i, name := range unknown {
+		skip(i, fmt.Sprintf("needs unknown group %s", name))
+	}
+	var ready []int
+	for i := 0; i < n; i++ {
+		if pending[i] == 0 && !recorded[i] {
+			ready = append(ready, i)
+		}
+	}
+	running := 0
+	done := func(ed *execData) {
+		running--
+		for _, d := range dependents[ed.id] {
+			if ed.status != StatusOK {
+				skip(d, fmt.Sprintf("needs %s, which %s", ed.name, verb(ed.status)))
+				continue
+			}
+			pending[d]--
+			if pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	for {
+		// blocks skipped while waiting in ready are dropped.
+		k := 0
+		for _, i := range ready {
+			if !recorded[i] {
+				ready[k] = i
+				k++
+			}
+		}
+		ready = ready[:k]
+		if len(ready) == 0 && running == 0 {
+			break
+		}
+		var b []*execData
+		for _, i := range ready {
+			if len(b) == batch {
+				break
+			}
+			b = append(b, block(i))
+		}
+		// a nil channel blocks forever, so nothing is sent while no block
+		// is ready.
+		send := edCh
+		if len(b) == 0 {
+			send = nil
+		}
+		start := time.Now()
+		for _, ed := range b {
+			ed.enqueued = start
+		}
+		select {
+		case send <- b:
+			rn.stats.enqueued(time.Since(start), len(edCh))
+			for _, ed := range b {
+				recorded[ed.id] = true
+			}
+			running += len(b)
+			ready = ready[len(b):]
+		case ed := <-rn.finished:
+			done(ed)
+		case <-ctx.Done():
+			// the blocks already in the queue are recorded by the
+			// workers.
+			reason := cancelReason(ctx)
+			for i := range blocks {
+				if !recorded[i] {
+					record(i, reason)
+				}
+			}
+			return
+		}
+	}
+	// the blocks left are in a cycle or need one that is, which they all
+	// are told rather than that the first one of them was not started.
+	for i := range blocks {
+		if !recorded[i] {
+			record(i, "needs groups in a dependency cycle")
+		}
+	}
+}
+
+// verb describes a status as the end of a sentence.
+func verb(s Status) string {
+	switch s {
+	case StatusOK:
+		return "succeeded"
+	case StatusNotStarted, StatusCancelled, StatusSkipped:
+		return "was " + string(s)
+	default:
+		return string(s)
+	}
+}
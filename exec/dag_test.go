@@ -0,0 +1,122 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lazyGroups is a GroupList telling its names and needs without building its
+// groups, which counts how many times each one is built.
+type lazyGroups struct {
+	GroupList
+	built map[string]int
+}
+
+func (l *lazyGroups) Group(i int) *Group {
+	l.built[l.GroupList[i].Name]++
+	return l.GroupList[i]
+}
+
+// group returns a group called name running cmd, which needs the groups
+// listed in needs.
+func group(name, cmd, needs string) *Group {
+	return &Group{
+		Name:  name,
+		Tasks: []*Task{{Name: cmd, Cmd: cmd}},
+		Needs: strings.Fields(needs),
+	}
+}
+
+func TestDispatchDAG(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups GroupList
+		// want is the status of every group, and the reason if it was
+		// not started.
+		want map[string]string
+	}{
+		{
+			name:   "chain",
+			groups: GroupList{group("a", "true", ""), group("b", "true", "a"), group("c", "true", "b")},
+			want:   map[string]string{"a": "ok", "b": "ok", "c": "ok"},
+		},
+		{
+			name: "failed need",
+			groups: GroupList{
+				group("a", "false", ""), group("b", "true", "a"), group("c", "true", "b"), group("d", "true", ""),
+			},
+			want: map[string]string{
+				"a": "failed",
+				"b": "not started: needs a, which failed",
+				"c": "not started: needs b, which was not started",
+				"d": "ok",
+			},
+		},
+		{
+			name:   "unknown need",
+			groups: GroupList{group("a", "true", "missing"), group("b", "true", "a")},
+			want: map[string]string{
+				"a": "not started: needs unknown group missing",
+				"b": "not started: needs a, which was not started",
+			},
+		},
+		{
+			name:   "cycle",
+			groups: GroupList{group("a", "true", "b"), group("b", "true", "a"), group("c", "true", "")},
+			want: map[string]string{
+				"a": "not started: needs groups in a dependency cycle",
+				"b": "not started: needs groups in a dependency cycle",
+				"c": "ok",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRunner()
+			r.Out = ioutil.Discard
+			r.Workers = 2
+			groups := &lazyGroups{GroupList: tt.groups, built: make(map[string]int)}
+			st := r.Run(context.Background(), groups)
+			got := make(map[string]string)
+			for _, g := range st.Groups() {
+				s := string(g.Status)
+				if g.Status == StatusNotStarted {
+					s += ": " + g.Reason
+				}
+				got[g.Group] = s
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groups = %q, want %q", got, tt.want)
+			}
+			for name, s := range got {
+				want := 1
+				if strings.HasPrefix(s, string(StatusNotStarted)) {
+					want = 0
+				}
+				if groups.built[name] != want {
+					t.Errorf("group %s built %d times, want %d", name, groups.built[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	s := &Stats{blocks: []blockStat{
+		{name: "a", ran: 3},
+		{name: "b", ran: 2, needs: []string{"a"}},
+		{name: "c", ran: 4},
+		{name: "d", ran: 1, needs: []string{"b", "c"}},
+	}}
+	path, length := s.criticalPath()
+	if want := []int{0, 1, 3}; !reflect.DeepEqual(path, want) || length != 6 {
+		t.Errorf("criticalPath() = %v, %v, want %v, 6", path, length, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// Kinds of errors starting a command.
+const (
+	StartNotFound   = "not found"
+	StartNoDir      = "no directory"
+	StartPermission = "permission denied"
+	StartFormat     = "exec format"
+	StartFailed     = "start failed"
+)
+
+// startError is returned by an execfunc whose command could not be started.
+type startError struct {
+	name string
+	// kind is one of the Start constants.
+	kind string
+	msg  string
+}
+
+func (e *startError) Error() string {
+	return e.name + ": " + e.msg
+}
+
+// diagnose returns the error starting cmd, which failed with err, explained
+// in terms of what the user can do about it. name identifies the task.
+func diagnose(name string, cmd *osexec.Cmd, err error) error {
+	e := &startError{name: name, kind: StartFailed, msg: err.Error()}
+	switch err := err.(type) {
+	case *osexec.Error:
+		if err.Err == osexec.ErrNotFound {
+			e.kind = StartNotFound
+			e.msg = fmt.Sprintf("command %q not found in PATH %s; give its full path, or run it through a shell if it is a shell builtin or alias",
+				err.Name, envPath(cmd))
+		}
+	case *os.PathError:
+		path := err.Path
+		// relative paths are started from the directory of the command.
+		full := path
+		if cmd.Dir != "" && !filepath.IsAbs(path) {
+			full = filepath.Join(cmd.Dir, path)
+		}
+		fi, serr := os.Stat(full)
+		switch {
+		case cmd.Dir != "" && !isDir(cmd.Dir):
+			// starting reports a missing directory as if it was the
+			// command.
+			e.kind = StartNoDir
+			e.msg = fmt.Sprintf("directory %s does not exist", cmd.Dir)
+		case os.IsNotExist(err.Err) && serr == nil && interpreter(full) != "":
+			// the command is there, what is missing is the interpreter
+			// of its #! line.
+			e.kind = StartNotFound
+			e.msg = fmt.Sprintf("%s: interpreter %q of its #! line not found", path, interpreter(full))
+		case os.IsNotExist(err.Err):
+			e.kind = StartNotFound
+			e.msg = fmt.Sprintf("%s does not exist", path)
+			if cmd.Dir != "" && !filepath.IsAbs(path) {
+				e.msg += " in " + cmd.Dir
+			}
+		case os.IsPermission(err.Err) && serr == nil && fi.IsDir():
+			e.kind = StartPermission
+			e.msg = fmt.Sprintf("%s is a directory", path)
+		case os.IsPermission(err.Err) && serr == nil:
+			e.kind = StartPermission
+			e.msg = fmt.Sprintf("%s is not executable, its mode is %v; make it executable or run it through a shell", path, fi.Mode())
+		case os.IsPermission(err.Err):
+			e.kind = StartPermission
+			e.msg = fmt.Sprintf("%s: %v, check the permissions of the directories leading to it", path, err.Err)
+		case err.Err == syscall.ENOEXEC:
+			e.kind = StartFormat
+			e.msg = fmt.Sprintf("%s is neither a binary for this system nor a script with a #! line; add one or run it through a shell", path)
+		}
+	}
+	return e
+}
+
+// lookEnvPath looks the command file up in the PATH of env, which is used
+// instead of the one of parexec when it sets its own. ok is false if the
+// command does not have to be looked up there, and path is empty if it is not
+// found.
+func lookEnvPath(file string, env []string) (path string, ok bool) {
+	if strings.ContainsRune(file, filepath.Separator) || runtime.GOOS == "windows" {
+		return "", false
+	}
+	list, ok := getEnv(env, "PATH")
+	if !ok || list == os.Getenv("PATH") {
+		return "", false
+	}
+	for _, dir := range filepath.SplitList(list) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, true
+		}
+	}
+	return "", true
+}
+
+// getEnv returns the last value of key in env.
+func getEnv(env []string, key string) (value string, ok bool) {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value, ok = kv[len(key)+1:], true
+		}
+	}
+	return value, ok
+}
+
+// envPath returns the PATH of cmd, the one of parexec if cmd does not set its
+// own.
+func envPath(cmd *osexec.Cmd) string {
+	if path, ok := getEnv(cmd.Env, "PATH"); ok {
+		return path
+	}
+	return os.Getenv("PATH")
+}
+
+// isDir reports whether path is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// interpreter returns the interpreter of the #! line of the script at path,
+// empty if it has none.
+func interpreter(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	line = strings.TrimSpace(line[2:])
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// Filter changes what the console shows of the output of a task, line by
+// line. Log files and the other sinks get the output as it is.
+type Filter struct {
+	// Include, if set, only shows the lines matching one of its regexps,
+	// and Exclude hides the ones matching any of its.
+	Include []string `json:",omitempty"`
+	Exclude []string `json:",omitempty"`
+	// Strip is a regexp removed from the start of the lines, e.g. the
+	// timestamps of a tool.
+	Strip string `json:",omitempty"`
+	// JSON pretty prints the lines that are json objects or arrays.
+	JSON bool `json:",omitempty"`
+}
+
+// Check returns an error if the regexps of the filter are not valid.
+func (f *Filter) Check() error {
+	_, err := f.compile()
+	return err
+}
+
+// lineFilter is a compiled Filter.
+type lineFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	strip   *regexp.Regexp
+	json    bool
+}
+
+func (f *Filter) compile() (*lineFilter, error) {
+	lf := &lineFilter{json: f.JSON}
+	compile := func(field string, exprs []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, e := range exprs {
+			re, err := regexp.Compile(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", field, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var err error
+	if lf.include, err = compile("include", f.Include); err != nil {
+		return nil, err
+	}
+	if lf.exclude, err = compile("exclude", f.Exclude); err != nil {
+		return nil, err
+	}
+	if f.Strip != "" {
+		if lf.strip, err = regexp.Compile("^(?:" + f.Strip + ")"); err != nil {
+			return nil, fmt.Errorf("strip: %v", err)
+		}
+	}
+	return lf, nil
+}
+
+// filterWriter writes to w the lines written to it as the filter has them
+// shown. Lines are written one at a time.
+type filterWriter struct {
+	f    *lineFilter
+	w    io.Writer
+	name string
+	// hidden counts the lines the filter did not show.
+	hidden int
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	line := bytes.TrimSuffix(p, []byte("\n"))
+	nl := len(line) < n
+	if !fw.shown(line) {
+		fw.hidden++
+		return n, nil
+	}
+	if fw.f.strip != nil {
+		line = fw.f.strip.ReplaceAll(line, nil)
+	}
+	if fw.f.json {
+		if t := bytes.TrimSpace(line); len(t) > 0 && (t[0] == '{' || t[0] == '[') {
+			var b bytes.Buffer
+			if json.Indent(&b, t, "", "  ") == nil {
+				line = b.Bytes()
+			}
+		}
+	}
+	if nl {
+		line = append(line[:len(line):len(line)], '\n')
+	}
+	if _, err := fw.w.Write(line); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// shown tells whether the filter shows line.
+func (fw *filterWriter) shown(line []byte) bool {
+	for _, re := range fw.f.exclude {
+		if re.Match(line) {
+			return false
+		}
+	}
+	if len(fw.f.include) == 0 {
+		return true
+	}
+	for _, re := range fw.f.include {
+		if re.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// report tells how many lines the filter hid, if any.
+func (fw *filterWriter) report(w io.Writer) {
+	if fw.hidden > 0 {
+		fmt.Fprintf(w, "%s: %d lines hidden by the filter\n", fw.name, fw.hidden)
+		fw.hidden = 0
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"os"
+)
+
+// maxRSS returns 0, the peak memory of processes is not measured on Windows.
+func maxRSS(ps *os.ProcessState) int64 {
+	return 0
+}
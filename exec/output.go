@@ -0,0 +1,534 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// readerSize is the size of the buffer used to split command output in
+// lines. Lines longer than this are forwarded in chunks, so memory used per
+// command is bounded no matter how much output it produces.
+const readerSize = 32 * 1024
+
+// readerPool keeps line readers around between commands. Runs with thousands
+// of short commands would otherwise allocate a new buffer for every one of
+// them. Readers are created with a fixed size, so pooled memory is capped at
+// readerSize per reader.
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, readerSize)
+	},
+}
+
+// maxPooledBuffer is the capacity over which capture buffers are dropped
+// instead of going back to bufferPool, which caps the memory it holds.
+const maxPooledBuffer = 64 * 1024
+
+// bufferPool keeps the buffers capturing the stderr of commands that print it
+// after their stdout.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty capture buffer from bufferPool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns b to bufferPool unless it grew too large.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// syncWriter serializes writes to an underlying writer. Workers running in
+// parallel share the console, and every write is a full line, so output of
+// different commands never gets mixed within a line.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// NewSyncWriter returns a writer serializing the writes to w, so that it can
+// be shared by goroutines writing full lines without mixing them. w is
+// returned as is if it is already such a writer.
+func NewSyncWriter(w io.Writer) io.Writer {
+	if w == nil {
+		w = os.Stdout
+	}
+	if s, ok := w.(*syncWriter); ok {
+		return s
+	}
+	return &syncWriter{w: w}
+}
+
+// stream reads r line by line and writes each line to every sink as soon as
+// it arrives. The line is read once and handed to all the sinks, nothing is
+// copied per sink. A sink that fails is dropped and the others keep receiving
+// output; once every sink has failed the rest of r is drained, so that the
+// command writing to it does not block. The first sink error is returned
+// after r is exhausted.
+func stream(r io.Reader, sinks ...io.Writer) error {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	defer func() {
+		// drop the reference to r so it can be collected while br sits in
+		// the pool.
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+	return streamLines(br, sinks...)
+}
+
+// streamLines is stream reading the lines with br.
+func streamLines(br *bufio.Reader, sinks ...io.Writer) error {
+	live := make([]io.Writer, len(sinks))
+	copy(live, sinks)
+	var serr error
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			n := 0
+			for _, s := range live {
+				if _, werr := s.Write(line); werr != nil {
+					if serr == nil {
+						serr = werr
+					}
+					continue
+				}
+				live[n] = s
+				n++
+			}
+			live = live[:n]
+			if n == 0 {
+				io.Copy(ioutil.Discard, br)
+				return serr
+			}
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return serr
+		default:
+			return err
+		}
+	}
+}
+
+// queueSize is how many bytes a queued sink holds while its writer catches
+// up.
+const queueSize = 1024 * 1024
+
+// queued is a sink forwarding what is written to it to w from a goroutine of
+// its own, so a slow w does not hold back the command nor the other sinks of
+// its output. What is written while the queue is full is dropped and counted.
+// Both streams of a command write to it at the same time.
+type queued struct {
+	mu      sync.Mutex
+	buf     []byte
+	closed  bool
+	dropped int64
+
+	// ready has a value while buf has something to forward or the sink was
+	// closed.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// newQueued starts forwarding to w. Once w fails the rest is discarded.
+func newQueued(w io.Writer) *queued {
+	q := &queued{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		var spare []byte
+		var err error
+		for range q.ready {
+			q.mu.Lock()
+			b, closed := q.buf, q.closed
+			q.buf = spare[:0]
+			q.mu.Unlock()
+			if len(b) > 0 && err == nil {
+				_, err = w.Write(b)
+			}
+			spare = b
+			if closed {
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// Write queues a copy of p, the line readers reuse their buffers. It never
+// fails.
+func (q *queued) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	if len(q.buf)+len(p) > queueSize {
+		q.dropped += int64(len(p))
+		q.mu.Unlock()
+		return len(p), nil
+	}
+	q.buf = append(q.buf, p...)
+	q.mu.Unlock()
+	q.signal()
+	return len(p), nil
+}
+
+func (q *queued) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close stops accepting writes and returns a channel closed once the queue
+// is drained.
+func (q *queued) close() <-chan struct{} {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+	return q.done
+}
+
+// droppedBytes returns how many bytes were dropped.
+func (q *queued) droppedBytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// counter is a sink counting the bytes and lines written to it.
+type counter struct {
+	bytes int64
+	lines int64
+	// partial is set while the last line written is not terminated.
+	partial bool
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			c.lines++
+		}
+	}
+	if len(p) > 0 {
+		c.partial = p[len(p)-1] != '\n'
+	}
+	c.bytes += int64(len(p))
+	return len(p), nil
+}
+
+// count returns the bytes and lines written, an unterminated last line
+// included.
+func (c *counter) count() (bytes, lines int64) {
+	lines = c.lines
+	if c.partial {
+		lines++
+	}
+	return c.bytes, lines
+}
+
+// tailSize is how many bytes of the end of the standard error of a command
+// are kept to report why it failed.
+const tailSize = 1024
+
+// tail is a sink keeping the last tailSize bytes written to it.
+type tail struct {
+	b []byte
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > tailSize {
+		t.b = append(t.b[:0], t.b[len(t.b)-tailSize:]...)
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last line written that is not blank.
+func (t *tail) lastLine() string {
+	s := strings.TrimSpace(string(t.b))
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = strings.TrimSpace(s[i+1:])
+	}
+	return s
+}
+
+// separateSize is how much of the end of the standard error of a command is
+// kept to print it after its standard output.
+const separateSize = 1 << 20
+
+// tailBuffer keeps the last separateSize bytes written to b, counting the
+// ones dropped to make room.
+type tailBuffer struct {
+	b       *bytes.Buffer
+	dropped int64
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if n >= separateSize {
+		t.dropped += int64(t.b.Len() + n - separateSize)
+		t.b.Reset()
+		p = p[n-separateSize:]
+	} else if over := t.b.Len() + n - separateSize; over > 0 {
+		t.b.Next(over)
+		t.dropped += int64(over)
+	}
+	t.b.Write(p)
+	return n, nil
+}
+
+// trim drops what is left of the first line kept if its start was dropped,
+// so that only whole lines remain.
+func (t *tailBuffer) trim() {
+	if t.dropped == 0 {
+		return
+	}
+	if i := bytes.IndexByte(t.b.Bytes(), '\n'); i >= 0 {
+		t.b.Next(i + 1)
+		t.dropped += int64(i + 1)
+	}
+}
+
+// hexdumpSize is how many bytes of binary output are kept for a hex dump.
+const hexdumpSize = 64
+
+// binaryGuard forwards output to w as long as it looks like text. Once a line
+// contains a NUL byte or is not valid UTF-8 the guard swallows the rest of the
+// output, so binary data never reaches the terminal, and only counts it.
+type binaryGuard struct {
+	w      io.Writer
+	binary bool
+	// cut is how many bytes of a character the last writes ended in the
+	// middle of are missing, the next write starts with them.
+	cut int
+	// suppressed is the number of bytes that were not forwarded.
+	suppressed int64
+	// head holds the first bytes of binary output.
+	head []byte
+}
+
+func (g *binaryGuard) Write(p []byte) (int, error) {
+	if !g.binary {
+		q := p
+		for ; g.cut > 0 && len(q) > 0 && !utf8.RuneStart(q[0]); g.cut-- {
+			q = q[1:]
+		}
+		g.binary = looksBinary(q)
+		if len(q) > 0 {
+			g.cut = missing(q)
+		}
+	}
+	if !g.binary {
+		return g.w.Write(p)
+	}
+	if n := hexdumpSize - len(g.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		g.head = append(g.head, p[:n]...)
+	}
+	g.suppressed += int64(len(p))
+	return len(p), nil
+}
+
+// report tells w how much binary output of the function name was suppressed,
+// if any, followed by a dump of its first bytes if hexdump is set.
+func (g *binaryGuard) report(w io.Writer, name string, hexdump bool) {
+	if !g.binary {
+		return
+	}
+	fmt.Fprintf(w, "%s: %s binary output suppressed\n", name, formatBytes(g.suppressed))
+	if hexdump {
+		fmt.Fprint(w, hex.Dump(g.head))
+	}
+}
+
+// looksBinary reports whether p is not printable text. A multi-byte
+// character cut at the end of p, which happens when long lines are forwarded
+// in chunks, does not count as invalid.
+func looksBinary(p []byte) bool {
+	if bytes.IndexByte(p, 0) >= 0 {
+		return true
+	}
+	if cutRune(p) {
+		p = p[:lastRuneStart(p)]
+	}
+	return !utf8.Valid(p)
+}
+
+// cutRune reports whether p ends in the middle of a multi-byte character.
+func cutRune(p []byte) bool {
+	return missing(p) > 0
+}
+
+// missing returns how many bytes of the multi-byte character p ends in the
+// middle of are missing, 0 if it ends with a whole one.
+func missing(p []byte) int {
+	i := lastRuneStart(p)
+	if i < 0 || utf8.FullRune(p[i:]) {
+		return 0
+	}
+	n := 2
+	switch b := p[i]; {
+	case b >= 0xf0:
+		n = 4
+	case b >= 0xe0:
+		n = 3
+	}
+	return n - (len(p) - i)
+}
+
+// lastRuneStart returns the index of the byte starting the last character of
+// p, -1 if there is none among its last bytes.
+func lastRuneStart(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// formatBytes formats n as a human readable size, e.g. 1.2MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// pipe holds the standard output of a function, which the next one of its
+// group reads as its standard input. It is kept in a temporary file, so it
+// does not take memory however large it is, and every attempt of the next
+// function reads it from the start.
+type pipe struct {
+	f *os.File
+}
+
+// reset discards what the pipe holds and returns where to write its new
+// contents.
+func (p *pipe) reset() (io.Writer, error) {
+	p.close()
+	f, err := ioutil.TempFile("", "parexec-pipe-")
+	if err != nil {
+		return nil, err
+	}
+	p.f = f
+	return f, nil
+}
+
+// reader returns a reader of what the pipe holds, nil if nothing was ever
+// written to it.
+func (p *pipe) reader() io.Reader {
+	if p.f == nil {
+		return nil
+	}
+	return io.NewSectionReader(p.f, 0, math.MaxInt64)
+}
+
+// close removes the file of the pipe.
+func (p *pipe) close() {
+	if p.f != nil {
+		p.f.Close()
+		os.Remove(p.f.Name())
+		p.f = nil
+	}
+}
+
+// prefixer starts every line written to w with prefix. Lines forwarded in
+// chunks only get it once, and each line is written at once along with its
+// prefix so that lines of different commands do not get mixed.
+type prefixer struct {
+	w      io.Writer
+	prefix string
+	// mid is set while the last line written is not terminated.
+	mid bool
+	buf []byte
+}
+
+func (p *prefixer) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	p.buf = p.buf[:0]
+	if !p.mid {
+		p.buf = append(p.buf, p.prefix...)
+	}
+	p.buf = append(p.buf, b...)
+	p.mid = b[len(b)-1] != '\n'
+	if _, err := p.w.Write(p.buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// throttle forwards at most max lines per second to w and drops the rest. How
+// many lines were dropped is reported once the next second starts and when
+// the command is done, so a chatty command cannot flood the console shared
+// with everything else running in parallel.
+type throttle struct {
+	w    io.Writer
+	name string
+	max  int
+
+	window     time.Time
+	lines      int
+	suppressed int
+}
+
+func (t *throttle) Write(p []byte) (int, error) {
+	now := time.Now()
+	if now.Sub(t.window) >= time.Second {
+		t.flush()
+		t.window = now
+		t.lines = 0
+	}
+	if t.lines >= t.max {
+		t.suppressed++
+		return len(p), nil
+	}
+	t.lines++
+	return t.w.Write(p)
+}
+
+// flush reports the lines dropped so far.
+func (t *throttle) flush() {
+	if t.suppressed > 0 {
+		fmt.Fprintf(t.w, "%s: %d lines suppressed\n", t.name, t.suppressed)
+		t.suppressed = 0
+	}
+}
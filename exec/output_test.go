@@ -0,0 +1,187 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// shortOutput is what a short command typically prints, a few lines.
+var shortOutput = []byte(strings.Repeat("some line of output of a short command\n", 8))
+
+// BenchmarkStream streams the output of a short command with a line reader
+// from readerPool, as every command does.
+func BenchmarkStream(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(shortOutput)
+	for i := 0; i < b.N; i++ {
+		r.Reset(shortOutput)
+		stream(r, ioutil.Discard)
+	}
+}
+
+// BenchmarkStreamUnpooled streams the same output with a new line reader
+// every time, as it was done before readers were pooled.
+func BenchmarkStreamUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(shortOutput)
+	for i := 0; i < b.N; i++ {
+		r.Reset(shortOutput)
+		streamLines(bufio.NewReaderSize(r, readerSize), ioutil.Discard)
+	}
+}
+
+// BenchmarkCapture captures the stderr of a short command in a buffer from
+// bufferPool, as commands printing it separately do.
+func BenchmarkCapture(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(shortOutput)
+	for i := 0; i < b.N; i++ {
+		r.Reset(shortOutput)
+		buf := getBuffer()
+		stream(r, buf)
+		putBuffer(buf)
+	}
+}
+
+// BenchmarkCaptureUnpooled captures it in a new buffer every time.
+func BenchmarkCaptureUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	r := bytes.NewReader(shortOutput)
+	for i := 0; i < b.N; i++ {
+		r.Reset(shortOutput)
+		var buf bytes.Buffer
+		stream(r, &buf)
+	}
+}
+
+func TestBinaryGuard(t *testing.T) {
+	long := strings.Repeat("a", readerSize-1) + "é" + "tail\n"
+	tests := []struct {
+		name   string
+		writes []string
+		// binary tells whether the output is taken as binary, out is
+		// what is forwarded.
+		binary bool
+		out    string
+	}{
+		{
+			name:   "text",
+			writes: []string{"hello\n", "wörld\n"},
+			out:    "hello\nwörld\n",
+		},
+		{
+			name:   "character cut at the end",
+			writes: []string{"caf\xc3"},
+			out:    "caf\xc3",
+		},
+		{
+			name:   "character cut between chunks",
+			writes: []string{long[:readerSize], long[readerSize:]},
+			out:    long,
+		},
+		{
+			name:   "character cut twice",
+			writes: []string{"\xe2", "\x82", "\xac\n"},
+			out:    "€\n",
+		},
+		{
+			name:   "nul byte",
+			writes: []string{"text\n", "a\x00b\n", "more\n"},
+			binary: true,
+			out:    "text\n",
+		},
+		{
+			name:   "invalid utf-8",
+			writes: []string{"\xff\xfe\n"},
+			binary: true,
+		},
+		{
+			name:   "continuation bytes without a cut character",
+			writes: []string{"abc", "\xa9tail\n"},
+			binary: true,
+			out:    "abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			g := &binaryGuard{w: &out}
+			for _, w := range tt.writes {
+				g.Write([]byte(w))
+			}
+			if g.binary != tt.binary {
+				t.Errorf("binary = %v, want %v", g.binary, tt.binary)
+			}
+			if out.String() != tt.out {
+				t.Errorf("forwarded %q, want %q", out.String(), tt.out)
+			}
+		})
+	}
+}
+
+func TestStreamLongLineCutCharacter(t *testing.T) {
+	line := strings.Repeat("a", readerSize-1) + "é" + "tail\n"
+	var out bytes.Buffer
+	g := &binaryGuard{w: &out}
+	stream(strings.NewReader(line), g)
+	if g.binary || out.String() != line {
+		t.Errorf("binary = %v, forwarded %d bytes, want the line of %d", g.binary, out.Len(), len(line))
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	line := strings.Repeat("x", 1023) + "\n"
+	tb := &tailBuffer{b: new(bytes.Buffer)}
+	for i := 0; i < 3*separateSize/len(line); i++ {
+		tb.Write([]byte(line))
+	}
+	tb.Write([]byte("last\n"))
+	tb.trim()
+	if tb.b.Len() > separateSize {
+		t.Errorf("kept %d bytes, want at most %d", tb.b.Len(), separateSize)
+	}
+	if !strings.HasSuffix(tb.b.String(), "last\n") || !strings.HasPrefix(tb.b.String(), line) {
+		t.Errorf("kept %q...%q, want whole lines ending in the last one", tb.b.String()[:10], tb.b.String()[tb.b.Len()-10:])
+	}
+	if total := int64(tb.b.Len()) + tb.dropped; total != int64(3*separateSize+len("last\n")) {
+		t.Errorf("kept and dropped %d bytes, want %d", total, 3*separateSize+len("last\n"))
+	}
+}
+
+// blockedWriter holds every write until release is closed.
+type blockedWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestQueuedDropsWhenFull(t *testing.T) {
+	w := &blockedWriter{release: make(chan struct{})}
+	q := newQueued(w)
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	// the first write may already be taken by the goroutine, blocked in
+	// w, so the queue fills after queueSize more bytes at most.
+	for i := 0; i < 2*queueSize/len(chunk); i++ {
+		q.Write(chunk)
+	}
+	close(w.release)
+	<-q.close()
+	dropped := q.droppedBytes()
+	if dropped == 0 {
+		t.Error("nothing dropped writing twice the queue to a blocked writer")
+	}
+	if got := int64(w.buf.Len()) + dropped; got != 2*queueSize {
+		t.Errorf("forwarded and dropped %d bytes, want %d", got, 2*queueSize)
+	}
+}
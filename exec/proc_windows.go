@@ -0,0 +1,24 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// setProcessGroup does nothing, there are no process groups to signal on
+// Windows.
+func setProcessGroup(cmd *osexec.Cmd) {}
+
+// terminate kills the process of cmd, which cannot be asked to exit on
+// Windows.
+func terminate(cmd *osexec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// kill kills the process of cmd.
+func kill(cmd *osexec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by the tasks that count against the same
+// rate limit. It holds up to burst tokens, refilled at rate per second, and
+// every command start takes one.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter parses a rate limit such as 50/min, allowing up to 50 starts in
+// one go and refilling at 50 per minute. Units are s, sec, m, min, h and hour.
+func NewLimiter(spec string) (*Limiter, error) {
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit %q, want e.g. 50/min", spec)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q, want a positive count", spec)
+	}
+	var per time.Duration
+	switch strings.TrimSpace(parts[1]) {
+	case "s", "sec", "second":
+		per = time.Second
+	case "m", "min", "minute":
+		per = time.Minute
+	case "h", "hour":
+		per = time.Hour
+	default:
+		return nil, fmt.Errorf("invalid rate limit %q, unknown unit", spec)
+	}
+	return &Limiter{
+		rate:   float64(n) / per.Seconds(),
+		burst:  float64(n),
+		tokens: float64(n),
+		last:   time.Now(),
+	}, nil
+}
+
+// wait blocks until a token is available or ctx is done. A nil Limiter never
+// blocks.
+func (l *Limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// the token is taken right away, callers that find the bucket empty
+	// queue up behind each other.
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// retryBudget limits the number of retries all the blocks of a run can make
+// together, so a systemic outage does not turn into an avalanche of retries.
+// A nil budget is unlimited.
+type retryBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+func newretryBudget(n int) *retryBudget {
+	return &retryBudget{left: n}
+}
+
+// take uses one retry of the budget. It returns false if none is left.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.left == 0 {
+		return false
+	}
+	b.left--
+	return true
+}
+
+var (
+	jitterMu  sync.Mutex
+	jitterRnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// withJitter returns d randomly moved by up to the fraction j of it in either
+// direction, so blocks that failed together do not retry in lockstep.
+func withJitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	jitterMu.Lock()
+	f := jitterRnd.Float64()
+	jitterMu.Unlock()
+	return d + time.Duration((2*f-1)*j*float64(d))
+}
@@ -0,0 +1,583 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package exec runs groups of commands in parallel. The tasks of a group are
+// executed one after another, as each one usually depends on the outcome of
+// the previous, while groups are independent and run in parallel on a pool of
+// workers.
+//
+//	r := exec.NewRunner()
+//	stats := r.Run(ctx, exec.GroupList{
+//		{Name: "k8s", Tasks: []*exec.Task{
+//			{Name: "namespaces", Cmd: "kubectl", Args: []string{"get", "ns"}},
+//		}},
+//		{Name: "local", Tasks: []*exec.Task{
+//			{Name: "echoing", Cmd: "echo", Args: []string{"hi there"}},
+//			{Name: "lsing", Cmd: "ls", Args: []string{"."}},
+//		}},
+//	})
+//	stats.Print(os.Stdout)
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task is a command to execute.
+type Task struct {
+	// Name identifies the task in the output.
+	Name string
+	Cmd  string
+	Args []string
+	// Env is the environment of the command in the form returned by
+	// os.Environ. The command inherits the environment of the process if
+	// nil. A command without a path is looked up in its PATH.
+	Env []string
+	// Dir is the working directory of the command, the one of the process if
+	// empty.
+	Dir string
+	// MaxLinesPerSec limits the output lines per second the task prints,
+	// overriding the limit of the Runner if not 0.
+	MaxLinesPerSec int
+	// Limiter, if set, is waited on before the command is started. It is
+	// shared with other tasks, so it is not part of the json encoding of the
+	// task.
+	Limiter *Limiter `json:"-"`
+	// Timeout limits the time the command runs, 0 for no limit. When it
+	// expires the command is killed and the rest of the group is skipped.
+	Timeout time.Duration
+	// Retries is the number of times the command is run again if it fails.
+	// Retries count against the retry budget of the run.
+	Retries int
+	// Backoff is the wait before the first retry, it doubles after every
+	// failed attempt. 0 retries right away.
+	Backoff time.Duration
+	// MaxBackoff caps the wait between attempts, 0 for no cap.
+	MaxBackoff time.Duration
+	// Jitter randomly moves every wait by up to this fraction of it.
+	Jitter float64
+	// Stderr is what is done with the standard error of the command. The
+	// last line of it is part of the error of a failed command unless it is
+	// discarded.
+	Stderr StderrMode
+	// Templated makes Cmd and Args templates, executed right before the
+	// command starts with Vars and the outcome of the tasks of the group
+	// that ran before it as steps, by name. Each step has its stdout, up to
+	// 1MiB, exit code, status and whether it was a success, e.g.
+	// {{.steps.build.stdout | trim}}.
+	Templated bool
+	Vars      map[string]string `json:",omitempty"`
+	// When and Unless are conditions, templates executed right before the
+	// task runs that give true or false: the task is skipped unless When
+	// is true and Unless false. Besides Vars and steps, they see os, arch,
+	// the environment of the command as env and exists, which tells
+	// whether a path, relative to Dir, exists, e.g.
+	// {{and (eq .os "linux") .steps.build.success}}. A condition without
+	// {{ is a field, e.g. steps.build.success.
+	When   string `json:",omitempty"`
+	Unless string `json:",omitempty"`
+	// StdinFromPrevious feeds the standard output of the previous task of
+	// the group to the standard input of the command, as a shell pipe does.
+	// The output of the previous task is then not printed.
+	StdinFromPrevious bool
+	// Log is where the output of the command goes when the Runner has a
+	// log directory.
+	Log LogMode
+	// Output, if set, lists the sinks the output of the command goes to,
+	// one of the Output constants or a URL each, overriding Log.
+	Output []string `json:",omitempty"`
+	// Filter, if set, changes what the console shows of the output.
+	Filter *Filter `json:",omitempty"`
+	// Blocked, if not empty, is why the task must not run. The task and the
+	// rest of its group are skipped.
+	Blocked string
+}
+
+// StderrMode is what is done with the standard error of a command.
+type StderrMode string
+
+// Modes of the standard error of a command.
+const (
+	// StderrInterleave prints it along with the standard output as lines
+	// arrive. It is the default.
+	StderrInterleave StderrMode = "interleave"
+	// StderrSeparate prints it after the standard output, once the command
+	// exits. Only its last MiB is kept.
+	StderrSeparate StderrMode = "separate"
+	// StderrDiscard drops it.
+	StderrDiscard StderrMode = "discard"
+)
+
+// LogMode is where the output of a command goes when it is logged.
+type LogMode string
+
+// Modes of logging the output of a command.
+const (
+	// LogBoth writes it to the console and to the log file. It is the
+	// default.
+	LogBoth LogMode = "both"
+	// LogFile only writes it to the log file.
+	LogFile LogMode = "file"
+	// LogConsole only writes it to the console, the command has no log
+	// file.
+	LogConsole LogMode = "console"
+)
+
+// Sinks the output of a command can go to, besides http and https URLs the
+// output is posted to as it arrives.
+const (
+	// OutputConsole writes it to the console.
+	OutputConsole = "console"
+	// OutputFile writes it to the log file, if the Runner has a log
+	// directory.
+	OutputFile = "file"
+	// OutputEvents sends every line as an event, if the Runner has Events.
+	OutputEvents = "events"
+	// OutputDiscard drops it, it is only counted.
+	OutputDiscard = "discard"
+)
+
+// sinks returns where the output of the task goes: to the console, the log
+// file, as events and to the URLs of remotes.
+func (t *Task) sinks() (console, file, events bool, remotes []string) {
+	if t.Output == nil {
+		return t.Log != LogFile, t.Log != LogConsole, false, nil
+	}
+	for _, o := range t.Output {
+		switch o {
+		case OutputConsole:
+			console = true
+		case OutputFile:
+			file = true
+		case OutputEvents:
+			events = true
+		case OutputDiscard:
+		default:
+			remotes = append(remotes, o)
+		}
+	}
+	return console, file, events, remotes
+}
+
+// Group is a list of tasks executed one after another.
+type Group struct {
+	Name  string
+	Tasks []*Task
+	// Timeout limits the time all the tasks of the group take together, 0
+	// for no limit.
+	Timeout time.Duration
+	// Converge, if set, makes the group run again until it succeeds.
+	Converge *Converge
+	// Info is shown whenever the group does not succeed.
+	Info Info
+	// ContinueOnError runs the remaining tasks after one fails. By default
+	// they are skipped, as they usually depend on the failed one.
+	ContinueOnError bool
+	// Needs lists the names of the groups that have to succeed before this
+	// one is started. The group is not started if any of them does not
+	// succeed.
+	Needs []string
+	// Checks are verified before every attempt of the group, which fails
+	// without running any task if one of them does not pass.
+	Checks []Check
+}
+
+// Converge describes how a group is retried until it succeeds.
+type Converge struct {
+	// Interval is the wait before the first retry, it doubles after every
+	// failed attempt.
+	Interval time.Duration
+	// MaxInterval caps the wait between attempts, 0 for no cap.
+	MaxInterval time.Duration
+	// Deadline is the time after which no more attempts are made, counted
+	// from the start of the first one.
+	Deadline time.Duration
+	// Jitter randomly moves every wait by up to this fraction of it, e.g. 0.2
+	// for +/-20%.
+	Jitter float64
+}
+
+// Info is descriptive metadata of a group. It is shown whenever the group
+// does not succeed, so whoever looks at the failure knows who to ask and
+// where to look.
+type Info struct {
+	Owner   string `json:"owner,omitempty"`
+	Docs    string `json:"docs,omitempty"`
+	Runbook string `json:"runbook,omitempty"`
+}
+
+func (i Info) empty() bool {
+	return i == Info{}
+}
+
+func (i Info) String() string {
+	var s []string
+	if i.Owner != "" {
+		s = append(s, "owner: "+i.Owner)
+	}
+	if i.Docs != "" {
+		s = append(s, "docs: "+i.Docs)
+	}
+	if i.Runbook != "" {
+		s = append(s, "runbook: "+i.Runbook)
+	}
+	return strings.Join(s, ", ")
+}
+
+// Groups provides the groups of a run. Group is called right before the i-th
+// group is handed to a worker, so implementations can build groups lazily and
+// keep memory use independent of the number of groups.
+type Groups interface {
+	Len() int
+	Group(i int) *Group
+}
+
+// GroupDeps is implemented by Groups that tell the name, needs and info of a
+// group without building it. Groups are then only built as they are
+// dispatched, whether they have needs or not, and the ones that are never
+// started are not built at all; otherwise a run with needs builds all of them
+// upfront.
+type GroupDeps interface {
+	GroupName(i int) string
+	GroupNeeds(i int) []string
+	GroupInfo(i int) Info
+}
+
+// GroupList is a Groups holding all the groups in memory.
+type GroupList []*Group
+
+// Len implements Groups.
+func (l GroupList) Len() int { return len(l) }
+
+// Group implements Groups.
+func (l GroupList) Group(i int) *Group { return l[i] }
+
+// GroupName implements GroupDeps.
+func (l GroupList) GroupName(i int) string { return l[i].Name }
+
+// GroupNeeds implements GroupDeps.
+func (l GroupList) GroupNeeds(i int) []string { return l[i].Needs }
+
+// GroupInfo implements GroupDeps.
+func (l GroupList) GroupInfo(i int) Info { return l[i].Info }
+
+// Types of events.
+const (
+	EventStart  = "start"
+	EventFinish = "finish"
+	// EventOutput is a line printed by a task whose output goes to the
+	// events.
+	EventOutput = "output"
+)
+
+// Event is a task starting, finishing or printing a line.
+type Event struct {
+	Type  string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Group string    `json:"group"`
+	Task  string    `json:"task"`
+	// Result is the outcome of a finished task.
+	Result *Result `json:"result,omitempty"`
+	// Stream is stdout or stderr, and Line what the task printed to it,
+	// without the newline.
+	Stream string `json:"stream,omitempty"`
+	Line   string `json:"line,omitempty"`
+}
+
+// Markers delimit the output of blocks.
+type Markers interface {
+	// Start returns what is printed before the output of the block group.
+	Start(group string) string
+	// End returns what is printed after it, given the status of the block
+	// and its description.
+	End(group string, status Status, desc string) string
+}
+
+// FailureAction is what is done with a task that failed.
+type FailureAction int
+
+// Actions on a failed task.
+const (
+	// FailureFail keeps the task failed.
+	FailureFail FailureAction = iota
+	// FailureRetry runs the task again.
+	FailureRetry
+	// FailureSkip ignores the failure, the group goes on as if the task
+	// succeeded.
+	FailureSkip
+)
+
+// Runner runs groups in parallel on a pool of workers. Use NewRunner to get
+// one with the default settings.
+type Runner struct {
+	// Workers is the number of groups executed in parallel.
+	Workers int
+	// QueueSize is the maximum number of batches waiting for a worker.
+	QueueSize int
+	// Batch is the number of groups handed to a worker at once.
+	Batch int
+	// Out receives the output of the commands and progress messages. Writes
+	// to it are serialized by the runner.
+	Out io.Writer
+	// Grouped makes every group print its output as one chunk when it
+	// finishes.
+	Grouped bool
+	// LogDir, if set, is where the output of every task is written to, in
+	// LogDir/<group>/<task>.log, along with when every attempt started.
+	LogDir string
+	// Prefix starts every line the commands print with the name of their
+	// task, as in group/task | line, so that the output of groups running
+	// in parallel can be told apart.
+	Prefix bool
+	// HexDump prints the first bytes of binary output that is suppressed.
+	HexDump bool
+	// MaxLinesPerSec limits the output lines per second of every task, 0
+	// for no limit.
+	MaxLinesPerSec int
+	// RetryBudget is the maximum number of retries of all the groups of a
+	// run together, negative for no limit.
+	RetryBudget int
+	// RunID identifies the run in the statistics.
+	RunID string
+	// StopOnFailure stops starting groups once one fails or times out. The
+	// running ones are left to finish, the rest are not started.
+	StopOnFailure bool
+	// OnFailure, if set, is called when a task fails, to decide what to do
+	// with it. It is called by the workers, possibly at the same time.
+	OnFailure func(t *Task, err error) FailureAction
+	// Step, if set, is called before a task of group starts, with its
+	// templates executed, and the task is skipped if it returns false. It is
+	// called by the workers, possibly at the same time.
+	Step func(group string, t *Task) bool
+	// Events, if set, is called whenever a task starts or finishes. It is
+	// called by the workers, possibly at the same time.
+	Events func(Event)
+	// KillGrace is the time the processes of a cancelled task are given to
+	// exit once asked to before they are killed.
+	KillGrace time.Duration
+	// Markers, if set, delimit the output of every block, for CI systems to
+	// fold it. Unless the output is grouped, the output of blocks running
+	// at the same time mixes within the markers.
+	Markers Markers
+
+	killMu sync.Mutex
+	kill   chan struct{}
+}
+
+// killed returns a channel closed by Kill.
+func (r *Runner) killed() <-chan struct{} {
+	r.killMu.Lock()
+	defer r.killMu.Unlock()
+	if r.kill == nil {
+		r.kill = make(chan struct{})
+	}
+	return r.kill
+}
+
+// Kill kills the processes of the cancelled tasks of the runs of r right away
+// instead of after the grace period, now and from then on.
+func (r *Runner) Kill() {
+	r.killed()
+	r.killMu.Lock()
+	defer r.killMu.Unlock()
+	select {
+	case <-r.kill:
+	default:
+		close(r.kill)
+	}
+}
+
+// NewRunner returns a Runner with one worker per CPU printing to os.Stdout.
+func NewRunner() *Runner {
+	return &Runner{
+		Workers:     runtime.NumCPU(),
+		QueueSize:   runtime.NumCPU(),
+		Batch:       1,
+		Out:         os.Stdout,
+		RetryBudget: -1,
+		KillGrace:   5 * time.Second,
+	}
+}
+
+// run holds the state of a single call to Runner.Run.
+type run struct {
+	*Runner
+	out     io.Writer
+	retries *retryBudget
+	stats   *Stats
+	// finished, if set, receives every block once a worker is done with it.
+	finished chan *execData
+	// halt is done once no more groups must be started, stop makes it done.
+	halt context.Context
+	stop func(reason string)
+}
+
+// Run executes groups and returns the statistics of the run once all of them
+// are done. When ctx is done the running groups are cancelled and the rest
+// are not started. If any group needs others, each one is started once the
+// ones it needs succeed. Groups implementing GroupDeps are then still built
+// as they are dispatched, the rest are all built upfront to learn their
+// needs.
+func (r *Runner) Run(ctx context.Context, groups Groups) *Stats {
+	rn := &run{
+		Runner: r,
+		out:    NewSyncWriter(r.Out),
+		stats:  newStats(r.RunID),
+	}
+	if r.RetryBudget >= 0 {
+		rn.retries = newretryBudget(r.RetryBudget)
+	}
+	rn.halt, rn.stop = WithCancelReason(ctx)
+	defer rn.stop("run finished")
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	// the queue is bounded, the dispatcher blocks when all workers are busy
+	// and QueueSize batches are already waiting.
+	edCh := make(chan []*execData, r.QueueSize)
+	dag := hasNeeds(groups)
+	if dag {
+		rn.finished = make(chan *execData, groups.Len())
+	}
+	// spawn n workers in charge of execute execData
+	for i := 0; i < workers; i++ {
+		go rn.executor(ctx, i, edCh, &wg)
+	}
+	if dag {
+		rn.dispatchDAG(rn.halt, groups, edCh)
+	} else {
+		rn.dispatch(rn.halt, groups, edCh)
+	}
+	close(edCh)
+	wg.Wait()
+	rn.stats.done()
+	return rn.stats
+}
+
+// executor is a worker that receives data to be executed. The data contains the
+// functions to be executed.
+// This will run inside a goroutine receiving batches of executable data
+// execData, each one containing an array of functions to be executed one after
+// another. Blocks of a batch are executed in order.
+// Once ctx is done the running block is cancelled and the blocks still queued
+// are not started, as they are not once the run is halted.
+func (rn *run) executor(ctx context.Context, id int, batchCh <-chan []*execData, wg *sync.WaitGroup) {
+	ws := workerStat{id: id}
+	for batch := range batchCh {
+		for _, edata := range batch {
+			if rn.halt.Err() != nil {
+				rn.stats.block(blockStat{name: edata.name, info: edata.info, status: StatusNotStarted,
+					reason: cancelReason(rn.halt)})
+				rn.finish(edata, StatusNotStarted)
+				continue
+			}
+			start := time.Now()
+			bs := blockStat{
+				name:  edata.name,
+				info:  edata.info,
+				wait:  start.Sub(edata.enqueued),
+				depth: len(batchCh),
+				needs: edata.needs,
+			}
+			if rn.Markers != nil {
+				io.WriteString(edata.out, rn.Markers.Start(edata.name))
+			}
+			rn.runBlock(ctx, edata, &bs)
+			for _, ts := range edata.tasks {
+				bs.tasks = append(bs.tasks, *ts)
+			}
+			if bs.status != StatusOK && !bs.info.empty() {
+				io.WriteString(edata.out, edata.name+": "+bs.describe()+"\n")
+			}
+			if rn.Markers != nil {
+				io.WriteString(edata.out, rn.Markers.End(edata.name, bs.status, bs.describe()+failures(edata.tasks)))
+			}
+			edata.flush(rn.out)
+			ws.last = time.Now()
+			bs.ran = ws.last.Sub(start)
+			ws.busy += bs.ran
+			rn.stats.block(bs)
+			if rn.StopOnFailure && (bs.status == StatusFailed || bs.status == StatusTimedOut) {
+				rn.stop(fmt.Sprintf("stopped after %s %s", edata.name, verb(bs.status)))
+			}
+			rn.finish(edata, bs.status)
+		}
+	}
+	rn.stats.worker(ws)
+	wg.Done()
+}
+
+// failures returns which of tasks failed and how, to describe their block.
+func failures(tasks []*taskStat) string {
+	var s []string
+	for _, ts := range tasks {
+		switch {
+		case ts.startErr != "":
+			s = append(s, fmt.Sprintf("%s could not be started (%s)", ts.name, ts.startErr))
+		case ts.status == StatusFailed && ts.exit >= 0:
+			s = append(s, fmt.Sprintf("%s failed with exit code %d", ts.name, ts.exit))
+		case ts.status == StatusFailed:
+			s = append(s, ts.name+" failed")
+		case ts.status == StatusTimedOut:
+			s = append(s, ts.name+" timed out")
+		}
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return "; " + strings.Join(s, ", ")
+}
+
+// dispatch builds the groups one by one and sends them to the workers through
+// edCh in batches. If ctx is done no more groups are sent and the remaining
+// ones are recorded as not started.
+func (rn *run) dispatch(ctx context.Context, groups Groups, edCh chan<- []*execData) {
+	batch := rn.Batch
+	if batch < 1 {
+		batch = 1
+	}
+	send := func(b []*execData) bool {
+		start := time.Now()
+		for _, ed := range b {
+			ed.enqueued = start
+		}
+		select {
+		case edCh <- b:
+		case <-ctx.Done():
+			return false
+		}
+		rn.stats.enqueued(time.Since(start), len(edCh))
+		return true
+	}
+	var b []*execData
+	n := groups.Len()
+	for i := 0; i < n; i++ {
+		// blocks are built just before being queued, so at most
+		// (QueueSize + Workers) * Batch exist at any time.
+		b = append(b, rn.newBlock(groups.Group(i)))
+		if len(b) == batch || i == n-1 {
+			if !send(b) {
+				reason := cancelReason(ctx)
+				for _, ed := range b {
+					rn.stats.block(blockStat{name: ed.name, info: ed.info, status: StatusNotStarted, reason: reason})
+				}
+				for j := i + 1; j < n; j++ {
+					rn.stats.block(notStarted(groups, j, reason))
+				}
+				return
+			}
+			b = nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shipGrace is how long a shipper is given to send what it has queued and get
+// the response once the command exits, before its request is abandoned.
+const shipGrace = 5 * time.Second
+
+// shipper posts the output of a command to a URL as the command writes it,
+// in a single request whose body ends when the command exits. Output is
+// queued, an endpoint slower than the command gets part of it.
+type shipper struct {
+	url    string
+	pw     *io.PipeWriter
+	q      *queued
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// ship starts posting to url the output of the task name of the run id,
+// until ctx is done.
+func ship(ctx context.Context, url, id, name string) *shipper {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(ctx)
+	s := &shipper{url: url, pw: pw, q: newQueued(pw), cancel: cancel, done: make(chan error, 1)}
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		s.done <- err
+		return s
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("X-Parexec-Run", id)
+	req.Header.Set("X-Parexec-Task", name)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("%s", resp.Status)
+			}
+		}
+		// writers are not left waiting on a request that is over.
+		pr.CloseWithError(err)
+		s.done <- err
+	}()
+	return s
+}
+
+// Write queues p to be sent, or drops it if the queue is full or sending
+// failed before. It never fails, so the other sinks of the output are not
+// affected.
+func (s *shipper) Write(p []byte) (int, error) {
+	return s.q.Write(p)
+}
+
+// close ends the request and returns the error posting the output, if any.
+// The request is abandoned if it is not over within shipGrace.
+func (s *shipper) close() error {
+	grace := time.NewTimer(shipGrace)
+	defer grace.Stop()
+	abandoned := false
+	select {
+	case <-s.q.close():
+	case <-grace.C:
+		// the request going away unblocks the queue.
+		abandoned = true
+		s.cancel()
+		<-s.q.done
+	}
+	s.pw.Close()
+	var err error
+	select {
+	case err = <-s.done:
+	case <-grace.C:
+		abandoned = true
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+	if abandoned {
+		err = fmt.Errorf("abandoned, the endpoint did not take the output within %v", shipGrace)
+	}
+	if n := s.q.droppedBytes(); n > 0 && (err == nil || abandoned) {
+		msg := fmt.Sprintf("%s of output dropped, the endpoint did not keep up", formatBytes(n))
+		if err != nil {
+			msg = err.Error() + ", " + msg
+		}
+		err = errors.New(msg)
+	}
+	return err
+}
+
+// eventWriter sends every line written to it as an output event of a task.
+type eventWriter struct {
+	rn     *run
+	group  string
+	task   string
+	stream string
+}
+
+func (e *eventWriter) Write(p []byte) (int, error) {
+	e.rn.event(Event{
+		Type:   EventOutput,
+		Time:   time.Now(),
+		Group:  e.group,
+		Task:   e.task,
+		Stream: e.stream,
+		Line:   strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
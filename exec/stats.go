@@ -0,0 +1,531 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Status is how a group ended.
+type Status string
+
+// Statuses of a group at the end of a run.
+const (
+	StatusOK         Status = "ok"
+	StatusFailed     Status = "failed"
+	StatusCancelled  Status = "cancelled"
+	StatusTimedOut   Status = "timed out"
+	StatusNotStarted Status = "not started"
+	StatusSkipped    Status = "skipped"
+)
+
+// blockStat holds the scheduling figures of a single execData block.
+type blockStat struct {
+	name   string
+	info   Info
+	status Status
+	// reason tells why a block was cancelled or timed out.
+	reason string
+	// wait is the time the block spent in the queue until a worker picked it.
+	wait time.Duration
+	// depth is the number of batches left in the queue when it was picked.
+	depth int
+	// ran is the time it took to execute all the functions of the block.
+	ran time.Duration
+	// usage is what the commands of the block consumed in all its attempts.
+	usage Usage
+	// checks holds the outcome of the checks of the block in its last
+	// attempt.
+	checks []CheckResult
+	// attempts is the number of times the block was run.
+	attempts int
+	// tasks holds the figures of the functions of the block in its last
+	// attempt.
+	tasks []taskStat
+	// needs are the blocks that had to succeed before this one started.
+	needs []string
+}
+
+// taskStat holds the figures of a single function of a block.
+type taskStat struct {
+	name   string
+	cmd    string
+	status Status
+	// exit is the exit code of the command, -1 if it did not exit on its
+	// own.
+	exit int
+	took time.Duration
+	// ran tells whether the function was started, it is false if it was
+	// skipped.
+	ran bool
+	// bytes and lines count the output the command wrote to stdout,
+	// errBytes and errLines the one to stderr.
+	bytes    int64
+	lines    int64
+	errBytes int64
+	errLines int64
+	// errTail is the end of the output to stderr.
+	errTail string
+	// usage is what the commands of the function consumed, its retries
+	// included.
+	usage Usage
+	// startErr is the kind of error starting the command, if it could not
+	// be started.
+	startErr string
+	// reason is why the function was skipped.
+	reason string
+}
+
+// Result is the outcome of a task in the last attempt of its group. Output is
+// not kept, only counted, so memory use does not depend on how much commands
+// print.
+type Result struct {
+	Group string `json:"group"`
+	Task  string `json:"task"`
+	// Cmd is the command line of the task.
+	Cmd    string `json:"cmd"`
+	Status Status `json:"status"`
+	// ExitCode is the exit code of the command, -1 if it was not started or
+	// was killed.
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration_ns"`
+	// Stdout and Stderr are the bytes and lines the command printed to each.
+	StdoutBytes int64 `json:"stdout_bytes"`
+	StdoutLines int64 `json:"stdout_lines"`
+	StderrBytes int64 `json:"stderr_bytes"`
+	StderrLines int64 `json:"stderr_lines"`
+	// StderrTail holds the last bytes the command printed to stderr.
+	StderrTail string `json:"stderr_tail,omitempty"`
+	// StartError is the kind of error starting the command if it could not
+	// be started, one of the Start constants.
+	StartError string `json:"start_error,omitempty"`
+	// Reason is why the task was skipped.
+	Reason string `json:"reason,omitempty"`
+	Usage
+}
+
+// GroupResult is the outcome of a group.
+type GroupResult struct {
+	Group  string `json:"group"`
+	Status Status `json:"status"`
+	// Reason tells why the group was cancelled, timed out or skipped.
+	Reason string `json:"reason,omitempty"`
+	Info
+}
+
+// result returns the outcome of the task, which belongs to group.
+func (t *taskStat) result(group string) Result {
+	return Result{
+		Group:       group,
+		Task:        t.name,
+		Cmd:         t.cmd,
+		Status:      t.status,
+		ExitCode:    t.exit,
+		Duration:    t.took,
+		StdoutBytes: t.bytes,
+		StdoutLines: t.lines,
+		StderrBytes: t.errBytes,
+		StderrLines: t.errLines,
+		StderrTail:  t.errTail,
+		StartError:  t.startErr,
+		Reason:      t.reason,
+		Usage:       t.usage,
+	}
+}
+
+func (t taskStat) String() string {
+	if !t.ran {
+		return "skipped"
+	}
+	s := "no output"
+	if t.bytes > 0 {
+		s = fmt.Sprintf("%d lines, %d bytes", t.lines, t.bytes)
+	}
+	if t.errBytes > 0 {
+		s += fmt.Sprintf(", stderr %d lines, %d bytes", t.errLines, t.errBytes)
+	}
+	return s
+}
+
+// workerStat holds how a worker spent its time during a run.
+type workerStat struct {
+	id   int
+	busy time.Duration
+	// last is when the worker finished its last block.
+	last time.Time
+}
+
+// Stats collects the statistics of a run. It is shared by the dispatcher and
+// every worker.
+type Stats struct {
+	mu       sync.Mutex
+	runID    string
+	start    time.Time
+	end      time.Time
+	blocks   []blockStat
+	workers  []workerStat
+	maxDepth int
+	// blocked is the time the dispatcher waited on a full queue.
+	blocked time.Duration
+}
+
+func newStats(runID string) *Stats {
+	return &Stats{runID: runID, start: time.Now()}
+}
+
+// enqueued records that the dispatcher had to wait d to put a batch in a
+// queue that has depth batches after the send.
+func (s *Stats) enqueued(d time.Duration, depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked += d
+	if depth > s.maxDepth {
+		s.maxDepth = depth
+	}
+}
+
+// block records the figures of an executed block.
+func (s *Stats) block(b blockStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = append(s.blocks, b)
+}
+
+// worker records the figures of a worker that has no more work to do.
+func (s *Stats) worker(w workerStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = append(s.workers, w)
+}
+
+// done marks the end of the run.
+func (s *Stats) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+}
+
+// Print writes a report of the scheduling statistics of the run to w, with
+// hints on how to make the next run faster.
+func (s *Stats) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total, max time.Duration
+	started := 0
+	for _, b := range s.blocks {
+		if b.status == StatusNotStarted {
+			continue
+		}
+		started++
+		total += b.wait
+		if b.wait > max {
+			max = b.wait
+		}
+	}
+	var avg time.Duration
+	if started > 0 {
+		avg = total / time.Duration(started)
+	}
+	wall := s.end.Sub(s.start)
+	fmt.Fprintf(w, "run %s: %v wall time, %d workers\n", s.runID, wall, len(s.workers))
+	fmt.Fprintf(w, "queue: %d blocks, max depth %d, dispatcher blocked %v\n",
+		len(s.blocks), s.maxDepth, s.blocked)
+	fmt.Fprintf(w, "queue wait: avg %v, max %v\n", avg, max)
+	path, _ := s.criticalPath()
+	critical := make(map[int]bool, len(path))
+	for _, i := range path {
+		critical[i] = true
+	}
+	for i, b := range s.blocks {
+		note := ""
+		if critical[i] {
+			note = " (critical path)"
+		}
+		if b.attempts > 1 {
+			note = fmt.Sprintf(", %d attempts%s", b.attempts, note)
+		}
+		status := string(b.status)
+		if b.reason != "" {
+			status += " (" + b.reason + ")"
+		}
+		fmt.Fprintf(w, "  %s: %s, waited %v, ran %v, %v, depth %d%s\n",
+			b.name, status, b.wait, b.ran, b.usage, b.depth, note)
+		for _, t := range b.tasks {
+			fmt.Fprintf(w, "    %s: %s\n", t.name, t)
+		}
+	}
+	sort.Slice(s.workers, func(i, j int) bool { return s.workers[i].id < s.workers[j].id })
+	var idle time.Duration
+	for _, ws := range s.workers {
+		idle += wall - ws.busy
+	}
+	if len(s.workers) > 0 && wall > 0 {
+		fmt.Fprintf(w, "workers: idle %.0f%% of the time\n",
+			100*float64(idle)/float64(wall*time.Duration(len(s.workers))))
+	}
+	for _, ws := range s.workers {
+		// tail is the time a worker sat idle at the end of the run waiting
+		// for the others. Large tails point at long sequential blocks that
+		// are worth splitting.
+		tail := wall
+		if !ws.last.IsZero() {
+			tail = s.end.Sub(ws.last)
+		}
+		fmt.Fprintf(w, "  worker-%d: busy %v, idle %v, idle at end %v\n",
+			ws.id, ws.busy, wall-ws.busy, tail)
+	}
+	for _, sg := range s.suggest() {
+		fmt.Fprintf(w, "suggestion: %s\n", sg)
+	}
+}
+
+// Results returns the outcome of every task that belongs to a group that was
+// started, in the order groups finished.
+func (s *Stats) Results() []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rs []Result
+	for _, b := range s.blocks {
+		for i := range b.tasks {
+			rs = append(rs, b.tasks[i].result(b.name))
+		}
+	}
+	return rs
+}
+
+// Groups returns the outcome of every group, in the order groups finished.
+func (s *Stats) Groups() []GroupResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs := make([]GroupResult, len(s.blocks))
+	for i, b := range s.blocks {
+		gs[i] = GroupResult{Group: b.name, Status: b.status, Reason: b.reason, Info: b.info}
+	}
+	return gs
+}
+
+// Counts returns how many groups ended with each status.
+func (s *Stats) Counts() map[Status]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := make(map[Status]int)
+	for _, b := range s.blocks {
+		count[b.status]++
+	}
+	return count
+}
+
+// Wall returns the time the run took.
+func (s *Stats) Wall() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end.Sub(s.start)
+}
+
+// Checks returns the outcome of the checks of every group that has any, in
+// their last attempt.
+func (s *Stats) Checks() []CheckResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []CheckResult
+	for _, b := range s.blocks {
+		r = append(r, b.checks...)
+	}
+	return r
+}
+
+// Usage returns what the commands of the run consumed.
+func (s *Stats) Usage() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage()
+}
+
+func (s *Stats) usage() Usage {
+	var u Usage
+	for _, b := range s.blocks {
+		u.add(b.usage)
+	}
+	return u
+}
+
+// GroupUsage returns what the commands of every group consumed, by the name
+// of the group.
+func (s *Stats) GroupUsage() map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]Usage, len(s.blocks))
+	for _, b := range s.blocks {
+		m[b.name] = b.usage
+	}
+	return m
+}
+
+// OK tells whether every group of the run succeeded. Groups skipped on
+// purpose do not count as failures.
+func (s *Stats) OK() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.blocks {
+		if b.status != StatusOK && b.status != StatusSkipped {
+			return false
+		}
+	}
+	return true
+}
+
+// Summary writes to w how many groups ended with each status and a table with
+// the outcome of every group and its tasks, followed by why the groups that
+// did not complete successfully ended that way.
+func (s *Stats) Summary(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := make(map[Status]int)
+	for _, b := range s.blocks {
+		count[b.status]++
+	}
+	fmt.Fprintf(w, "run %s: %d %s, %d %s, %d %s, %d %s, %d %s, %d %s in %v\n", s.runID,
+		count[StatusOK], StatusOK, count[StatusFailed], StatusFailed,
+		count[StatusTimedOut], StatusTimedOut, count[StatusCancelled], StatusCancelled,
+		count[StatusNotStarted], StatusNotStarted, count[StatusSkipped], StatusSkipped,
+		s.end.Sub(s.start))
+	fmt.Fprintf(w, "usage: %v\n", s.usage())
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  GROUP\tTASK\tSTATUS\tEXIT\tTIME\tCOMMAND")
+	for _, b := range s.blocks {
+		fmt.Fprintf(tw, "  %s\t\t%s\t\t%v\t\n", b.name, b.status, b.ran)
+		for _, t := range b.tasks {
+			status, exit, took := string(t.status), "-", "-"
+			if t.status != StatusNotStarted && t.status != StatusSkipped {
+				exit, took = fmt.Sprint(t.exit), fmt.Sprint(t.took)
+			}
+			if t.startErr != "" {
+				// the command never ran, it has no exit code.
+				status, exit = status+" ("+t.startErr+")", "-"
+			}
+			if t.reason != "" {
+				status += " (" + t.reason + ")"
+			}
+			fmt.Fprintf(tw, "  \t%s\t%s\t%s\t%s\t%s\n", t.name, status, exit, took, t.cmd)
+		}
+	}
+	tw.Flush()
+	for _, b := range s.blocks {
+		if b.status == StatusOK || (b.reason == "" && b.info.empty()) {
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s\n", b.name, b.describe())
+	}
+}
+
+// describe returns the status of the block along with why it ended that way
+// and its metadata, if any.
+func (b *blockStat) describe() string {
+	s := string(b.status)
+	if b.reason != "" {
+		s += " (" + b.reason + ")"
+	}
+	if !b.info.empty() {
+		s += ", " + b.info.String()
+	}
+	return s
+}
+
+// criticalPath returns the indexes of the chain of blocks, each needing the
+// one before, that ran the longest, along with how long it ran. The run can
+// never be shorter than it. Without needs it is the longest block alone.
+func (s *Stats) criticalPath() ([]int, time.Duration) {
+	byName := make(map[string]int, len(s.blocks))
+	for i, b := range s.blocks {
+		byName[b.name] = i
+	}
+	length := make([]time.Duration, len(s.blocks))
+	prev := make([]int, len(s.blocks))
+	// state is 1 while the chains leading to a block are measured and 2
+	// once they are, blocks in a cycle never ran.
+	state := make([]int, len(s.blocks))
+	var visit func(i int) time.Duration
+	visit = func(i int) time.Duration {
+		switch state[i] {
+		case 1:
+			return 0
+		case 2:
+			return length[i]
+		}
+		state[i] = 1
+		prev[i] = -1
+		var best time.Duration
+		for _, n := range s.blocks[i].needs {
+			j, ok := byName[n]
+			if !ok {
+				continue
+			}
+			if l := visit(j); l > best {
+				best, prev[i] = l, j
+			}
+		}
+		length[i] = best + s.blocks[i].ran
+		state[i] = 2
+		return length[i]
+	}
+	end := -1
+	for i := range s.blocks {
+		if l := visit(i); l > 0 && (end < 0 || l > length[end]) {
+			end = i
+		}
+	}
+	if end < 0 {
+		return nil, 0
+	}
+	var path []int
+	for i := end; i >= 0; i = prev[i] {
+		path = append([]int{i}, path...)
+	}
+	return path, length[end]
+}
+
+// suggest analyzes the recorded figures and returns hints to make the next run
+// faster or cheaper. It must be called with the lock held.
+func (s *Stats) suggest() []string {
+	path, longest := s.criticalPath()
+	wall := s.end.Sub(s.start)
+	if len(path) == 0 || wall <= 0 || len(s.workers) == 0 {
+		return nil
+	}
+	var ran, cpu time.Duration
+	for _, b := range s.blocks {
+		ran += b.ran
+		cpu += b.usage.CPU
+	}
+	names := make([]string, len(path))
+	for i, b := range path {
+		names[i] = s.blocks[b].name
+	}
+	workers := len(s.workers)
+	// beyond this many workers the critical path alone determines the
+	// wall time.
+	enough := int((ran + longest - 1) / longest)
+	var sgs []string
+	if enough <= workers && float64(longest) > 0.5*float64(wall) {
+		sgs = append(sgs, fmt.Sprintf("critical path is %s (%v, %.0f%% of the wall time); shortening it is the only way to finish sooner",
+			strings.Join(names, " -> "), longest, 100*float64(longest)/float64(wall)))
+	}
+	idle := 1 - float64(ran)/float64(wall*time.Duration(workers))
+	switch {
+	case enough < workers && idle > 0.3:
+		sgs = append(sgs, fmt.Sprintf("workers idle %.0f%% of the time; %d workers would finish in about the same time",
+			100*idle, enough))
+	case enough > workers && ran > 0 && float64(cpu) < 0.5*float64(ran):
+		sgs = append(sgs, fmt.Sprintf("blocks used %.0f%% cpu of their run time; being mostly idle, up to %d workers should help",
+			100*float64(cpu)/float64(ran), enough))
+	}
+	return sgs
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// stepOutputSize is how much of the standard output of a task is kept for the
+// templates of the tasks after it.
+const stepOutputSize = 1 << 20
+
+// templateFuncs are the functions templates of tasks can use besides the
+// builtin ones.
+var templateFuncs = template.FuncMap{
+	"trim": strings.TrimSpace,
+}
+
+// CheckTemplate returns an error if s is not a valid template of a task.
+func CheckTemplate(s string) error {
+	_, err := template.New("").Funcs(templateFuncs).Parse(s)
+	return err
+}
+
+// stepOutput keeps the first stepOutputSize bytes of the standard output of
+// a task.
+type stepOutput struct {
+	b         []byte
+	truncated bool
+}
+
+func (s *stepOutput) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := stepOutputSize - len(s.b); n > room {
+		p = p[:room]
+		s.truncated = true
+	}
+	s.b = append(s.b, p...)
+	return n, nil
+}
+
+func (s *stepOutput) reset() {
+	s.b, s.truncated = s.b[:0], false
+}
+
+// record adds the outcome of the task ts, whose standard output was kept in
+// out, to the steps of edata, if it has templated tasks.
+func (edata *execData) record(ts *taskStat, out *stepOutput) {
+	if edata.steps == nil {
+		return
+	}
+	step := map[string]interface{}{
+		"exit":    ts.exit,
+		"status":  string(ts.status),
+		"success": ts.status == StatusOK,
+	}
+	// a step whose output does not fit has none, so templates using it fail
+	// instead of getting part of it.
+	if out != nil && !out.truncated {
+		step["stdout"] = string(out.b)
+	}
+	if out != nil && out.truncated {
+		edata.truncated = append(edata.truncated, ts.name)
+	}
+	edata.steps[ts.name] = step
+}
+
+// execute executes the template s of a task with data and funcs, the template
+// functions besides templateFuncs.
+func (edata *execData) execute(s string, data map[string]interface{}, funcs template.FuncMap) (string, error) {
+	tmpl, err := template.New("").Funcs(templateFuncs).Funcs(funcs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		if len(edata.truncated) > 0 {
+			err = fmt.Errorf("%v (the output of %s is over %s and cannot be used)",
+				err, strings.Join(edata.truncated, ", "), formatBytes(stepOutputSize))
+		}
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// data returns what the templates of task t see: its vars and the steps of
+// edata.
+func (edata *execData) data(t *Task) map[string]interface{} {
+	data := make(map[string]interface{}, len(t.Vars)+1)
+	for k, v := range t.Vars {
+		data[k] = v
+	}
+	data["steps"] = edata.steps
+	return data
+}
+
+// argv returns the command line of the templated task t, executing its
+// templates with its vars and the steps of edata.
+func (edata *execData) argv(t *Task) (string, []string, error) {
+	data := edata.data(t)
+	execute := func(s string) (string, error) {
+		return edata.execute(s, data, nil)
+	}
+	cmd, err := execute(t.Cmd)
+	if err != nil {
+		return "", nil, err
+	}
+	args := make([]string, len(t.Args))
+	for i, a := range t.Args {
+		if args[i], err = execute(a); err != nil {
+			return "", nil, err
+		}
+	}
+	return cmd, args, nil
+}
+
+// resolved returns t as it is about to run, a copy with its command line
+// executed if it is templated. t is returned as it is if the templates fail,
+// running it reports why.
+func (edata *execData) resolved(t *Task) *Task {
+	if !t.Templated {
+		return t
+	}
+	cmd, args, err := edata.argv(t)
+	if err != nil {
+		return t
+	}
+	r := *t
+	r.Cmd, r.Args = cmd, args
+	return &r
+}
+
+// CheckCondition returns an error if s is not a valid condition of a task.
+func CheckCondition(s string) error {
+	_, err := template.New("").Funcs(templateFuncs).Funcs(conditionFuncs("")).Parse(conditionTemplate(s))
+	return err
+}
+
+// conditionTemplate returns the template of the condition s, which is a
+// field if it has no actions.
+func conditionTemplate(s string) string {
+	if strings.Contains(s, "{{") {
+		return s
+	}
+	return "{{." + strings.TrimPrefix(strings.TrimSpace(s), ".") + "}}"
+}
+
+// conditionFuncs returns the functions conditions of a task running in dir
+// can use.
+func conditionFuncs(dir string) template.FuncMap {
+	return template.FuncMap{
+		"exists": func(path string) bool {
+			if dir != "" && !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			_, err := os.Stat(path)
+			return err == nil
+		},
+	}
+}
+
+// condition tells whether task t is to run according to its conditions, and
+// if not why.
+func (edata *execData) condition(t *Task) (bool, string, error) {
+	if t.When == "" && t.Unless == "" {
+		return true, "", nil
+	}
+	data := edata.data(t)
+	data["os"], data["arch"] = runtime.GOOS, runtime.GOARCH
+	env := make(map[string]string)
+	environ := t.Env
+	if environ == nil {
+		environ = os.Environ()
+	}
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	data["env"] = env
+	eval := func(field, s string) (bool, error) {
+		r, err := edata.execute(conditionTemplate(s), data, conditionFuncs(t.Dir))
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", field, err)
+		}
+		r = strings.TrimSpace(r)
+		if r == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(r)
+		if err != nil {
+			return false, fmt.Errorf("%s: %q is neither true nor false", field, r)
+		}
+		return b, nil
+	}
+	if t.When != "" {
+		ok, err := eval("when", t.When)
+		if err != nil || !ok {
+			return false, fmt.Sprintf("when %s is false", t.When), err
+		}
+	}
+	if t.Unless != "" {
+		ok, err := eval("unless", t.Unless)
+		if err != nil || ok {
+			return false, fmt.Sprintf("unless %s is true", t.Unless), err
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Usage is what the processes of a task, a group or a run consumed.
+type Usage struct {
+	// CPU is the user and system time of the processes.
+	CPU time.Duration `json:"cpu_ns"`
+	// MaxRSS is the peak resident memory of the largest process in bytes,
+	// 0 where it cannot be measured.
+	MaxRSS int64 `json:"max_rss_bytes"`
+	// Processes is the number of commands started, retries included. The
+	// processes commands start themselves are not counted, but their CPU
+	// time and memory are once their parent has waited for them.
+	Processes int `json:"processes"`
+}
+
+// usageOf returns the usage of the exited process ps.
+func usageOf(ps *os.ProcessState) Usage {
+	return Usage{CPU: ps.UserTime() + ps.SystemTime(), MaxRSS: maxRSS(ps), Processes: 1}
+}
+
+// add adds o to u. Memory is not added up, processes that do not run at the
+// same time do not use it at the same time.
+func (u *Usage) add(o Usage) {
+	u.CPU += o.CPU
+	u.Processes += o.Processes
+	if o.MaxRSS > u.MaxRSS {
+		u.MaxRSS = o.MaxRSS
+	}
+}
+
+func (u Usage) String() string {
+	s := fmt.Sprintf("cpu %v", u.CPU)
+	if u.MaxRSS > 0 {
+		s += fmt.Sprintf(", peak rss %.1f MiB", float64(u.MaxRSS)/(1<<20))
+	}
+	return s + fmt.Sprintf(", %d processes", u.Processes)
+}
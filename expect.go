@@ -0,0 +1,60 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// checks returns the checks of what the block expects. Commands run and
+// variables are looked up in the environment of the block, fm being the
+// config it belongs to and base the environment it starts from.
+func (r execdataMeta) checks(fm *functionsMeta, base []string) []exec.Check {
+	if len(r.Expect) == 0 {
+		return nil
+	}
+	em := fm.envMeta.merge(r.envMeta)
+	env := em.environ(base)
+	cs := make([]exec.Check, 0, len(r.Expect))
+	for _, e := range r.Expect {
+		c := exec.Check{Name: e.Name, Want: e.Want}
+		if e.Cmd != "" {
+			cmd := e.Cmd
+			if strings.ContainsRune(cmd, filepath.Separator) {
+				cmd = rebase(e.base, cmd)
+			}
+			c.Cmd, c.Args, c.Env = em.lookPath(cmd), e.Args, env
+		} else {
+			c.Got = getenv(env, e.Var)
+		}
+		if c.Name == "" {
+			c.Name = e.describe()
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// describe returns what e checks, its command line or the variable.
+func (e expectMeta) describe() string {
+	if e.Cmd != "" {
+		return strings.Join(append([]string{e.Cmd}, e.Args...), " ")
+	}
+	return "$" + e.Var
+}
+
+// expand returns a copy of e with f applied to its strings.
+func (e expectMeta) expand(f func(string) string) expectMeta {
+	m := e
+	m.Name = f(e.Name)
+	m.Cmd = f(e.Cmd)
+	m.Args = expandAll(e.Args, f)
+	m.Var = f(e.Var)
+	m.Want = f(e.Want)
+	return m
+}
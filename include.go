@@ -0,0 +1,173 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFlag holds the paths of the repeated -config flag.
+type configFlag []string
+
+func (c *configFlag) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *configFlag) Set(s string) error {
+	*c = append(*c, s)
+	return nil
+}
+
+// loadConfig decodes the config at path, - for standard input, along with the
+// configs it includes, and returns them combined: the included ones first, in
+// order, so the config overrides their settings. Everything read is written to
+// h. stack lists the configs including this one, to detect cycles.
+func loadConfig(path string, strict bool, h io.Writer, stack []string) (*functionsMeta, error) {
+	var in io.Reader = os.Stdin
+	dir := "."
+	if path != "-" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stack {
+			if s == abs {
+				return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+			}
+		}
+		stack = append(stack, abs)
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		in = fd
+		dir = filepath.Dir(path)
+	}
+	c, err := decodeConfig(io.TeeReader(in, h), path, strict)
+	if err != nil {
+		return nil, err
+	}
+	f := &functionsMeta{}
+	for _, inc := range c.Include {
+		paths, err := includePaths(dir, inc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, p := range paths {
+			i, err := loadConfig(p, strict, h, stack)
+			if _, ok := err.(*os.PathError); ok {
+				return nil, fmt.Errorf("%s: include %s: %v", path, inc, err)
+			}
+			if err != nil {
+				return nil, err
+			}
+			f.combine(i)
+		}
+	}
+	c.Include = nil
+	if path != "-" {
+		c.setBase(dir)
+	}
+	f.combine(c)
+	return f, nil
+}
+
+// setBase records dir as the directory of the config of every function and
+// expectation f gives, those of its pipelines and templates included.
+func (f *functionsMeta) setBase(dir string) {
+	set := func(r *execdataMeta) {
+		for i := range r.Funcs {
+			r.Funcs[i].base = dir
+		}
+		for i := range r.Expect {
+			r.Expect[i].base = dir
+		}
+	}
+	for i := range f.Ex {
+		set(&f.Ex[i])
+	}
+	for _, p := range f.Pipelines {
+		for i := range p {
+			set(&p[i])
+		}
+	}
+	for name, t := range f.Templates {
+		set(&t.execdataMeta)
+		f.Templates[name] = t
+	}
+}
+
+// rebase returns path relative to base, the directory of the config giving
+// it, unless it is absolute.
+func rebase(base, path string) string {
+	if path == "" || base == "" || base == "." || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
+
+// configDirs returns the absolute directories of the configs at paths, the
+// current one for standard input.
+func configDirs(paths []string) []string {
+	dirs := make([]string, len(paths))
+	for i, p := range paths {
+		if p == "-" {
+			p = "."
+		} else {
+			p = filepath.Dir(p)
+		}
+		dirs[i], _ = filepath.Abs(p)
+	}
+	return dirs
+}
+
+// includePaths returns the paths of the configs include, given in a config in
+// dir, refers to. It can be a glob, matching at least one file.
+func includePaths(dir, include string) ([]string, error) {
+	p := include
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	if !strings.ContainsAny(include, "*?[") {
+		return []string{p}, nil
+	}
+	paths, err := filepath.Glob(p)
+	if err != nil {
+		return nil, fmt.Errorf("include %s: %v", include, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("include %s matches no files", include)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// combine adds the config o to f. The functions of o go after the ones of f,
+// and its pipelines and params are added to the ones of f, replacing the ones
+// with the same name. Settings are merged as layers are.
+func (f *functionsMeta) combine(o *functionsMeta) {
+	ex := append(f.Ex, o.Ex...)
+	pipelines, params := f.Pipelines, f.Params
+	for name, p := range o.Pipelines {
+		if pipelines == nil {
+			pipelines = make(map[string][]execdataMeta)
+		}
+		pipelines[name] = p
+	}
+	for name, p := range o.Params {
+		if params == nil {
+			params = make(map[string]paramMeta)
+		}
+		params[name] = p
+	}
+	f.merge(o)
+	f.Ex, f.Pipelines, f.Params = ex, pipelines, params
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// projectConfig is the name of the config parexec looks for when none is
+// given, defaultConfig the one used if it is not found.
+const (
+	projectConfig = "parexec.yaml"
+	defaultConfig = "config.yaml"
+)
+
+// findConfig returns the path of the nearest projectConfig found walking up
+// from the current directory, like git does with its repository, or
+// defaultConfig if there is none.
+func findConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return defaultConfig
+	}
+	for {
+		p := filepath.Join(dir, projectConfig)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return defaultConfig
+		}
+		dir = parent
+	}
+}
+
+// systemConfig is the config with the defaults of every user of the host.
+const systemConfig = "/etc/parexec/config.yaml"
+
+// layerPaths returns the paths of the configs with defaults that apply before
+// the project config, from the lowest precedence to the highest: the one of
+// the system, then the one of the user.
+func layerPaths() []string {
+	paths := []string{systemConfig}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		if home := os.Getenv("HOME"); home != "" {
+			dir = filepath.Join(home, ".config")
+		}
+	}
+	if dir != "" {
+		paths = append(paths, filepath.Join(dir, "parexec", "config.yaml"))
+	}
+	return paths
+}
+
+// decodeConfig decodes a config from in. name identifies the config in
+// errors.
+func decodeConfig(in io.Reader, name string, strict bool) (*functionsMeta, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading yaml file %s: %v", name, err)
+	}
+	if name == "-" {
+		name = "<stdin>"
+	}
+	f := &functionsMeta{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.SetStrict(strict)
+	if err := dec.Decode(f); err != nil && err != io.EOF {
+		return nil, decodeError(name, err)
+	}
+	f.locate(name, data)
+	return f, nil
+}
+
+// decodeLayer decodes the config with defaults at path. It returns nil if
+// there is no config there. Layers only hold settings, the functions to run
+// come from the project config.
+func decodeLayer(path string, strict bool) (*functionsMeta, error) {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	f, err := decodeConfig(fd, path, strict)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Ex) > 0 || len(f.Pipelines) > 0 || len(f.Params) > 0 || len(f.Include) > 0 {
+		return nil, fmt.Errorf("%s: functions, pipelines, params and include can only be given in the project config", path)
+	}
+	return f, nil
+}
+
+// merge overrides the settings of f with the ones o gives. Rate limits,
+// templates and vars are added to the ones of f, replacing the ones with the
+// same name.
+func (f *functionsMeta) merge(o *functionsMeta) {
+	if len(o.Ex) > 0 {
+		f.Ex = o.Ex
+	}
+	if len(o.Pipelines) > 0 {
+		f.Pipelines = o.Pipelines
+	}
+	if len(o.Params) > 0 {
+		f.Params = o.Params
+	}
+	for name, v := range o.Vars {
+		if f.Vars == nil {
+			f.Vars = make(map[string]string)
+		}
+		f.Vars[name] = v
+	}
+	for name, t := range o.Templates {
+		if f.Templates == nil {
+			f.Templates = make(map[string]templateMeta)
+		}
+		f.Templates[name] = t
+	}
+	for name, spec := range o.RateLimits {
+		if f.RateLimits == nil {
+			f.RateLimits = make(map[string]string)
+		}
+		f.RateLimits[name] = spec
+	}
+	if o.Timeout > 0 {
+		f.Timeout = o.Timeout
+	}
+	if o.ShellPath != "" {
+		f.ShellPath = o.ShellPath
+	}
+	if o.Concurrency > 0 {
+		f.Concurrency = o.Concurrency
+	}
+	f.envMeta = f.envMeta.merge(o.envMeta)
+}
+
+// showConfig implements the config show command. It prints the configs that
+// are layered, in order of precedence, or with -resolved the config that
+// results from layering them, the project config and the flags.
+func showConfig(args []string, configs []string, strict bool, workers int, params map[string]string) {
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	resolved := fs.Bool("resolved", false, "print the config that results from all the layers")
+	fs.Parse(args)
+	if !*resolved {
+		for _, p := range layerPaths() {
+			state := "not found"
+			if _, err := os.Stat(p); err == nil {
+				state = "found"
+			}
+			fmt.Printf("%s (%s)\n", p, state)
+		}
+		for _, c := range configs {
+			fmt.Printf("%s (project)\n", c)
+		}
+		return
+	}
+	fm := processConfig(configs, strict, "", params)
+	if workers > 0 {
+		fm.Concurrency = workers
+	}
+	out, err := yaml.Marshal(fm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// yamlKey matches a mapping key at the start of a line, quoted or not.
+	yamlKey = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"-][^:#]*?)\s*:(\s+|$)`)
+	// blockScalar matches the indicator of a literal or folded scalar,
+	// whose lines are text and not yaml.
+	blockScalar = regexp.MustCompile(`^[|>][-+0-9]*\s*(#.*)?$`)
+)
+
+// yamlNode is a key or a sequence item open while lines are scanned.
+type yamlNode struct {
+	indent int
+	item   bool
+	path   string
+	items  int
+}
+
+// scanLines returns the lines of the first document of the yaml in data at
+// which every key and sequence item starts, by path: the keys and item
+// indexes leading to it joined by slashes, e.g. functions/0/execdata/1. Only
+// block style yaml is followed, whatever is given in flow style or through
+// aliases has no line.
+func scanLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	var stack []*yamlNode
+	// scalar is the indentation of the key of the block scalar being
+	// skipped, -1 if none.
+	scalar := -1
+	started := false
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimRight(sc.Text(), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		indent := len(text) - len(content)
+		if content == "" {
+			continue
+		}
+		if scalar >= 0 {
+			if indent > scalar {
+				continue
+			}
+			scalar = -1
+		}
+		if strings.HasPrefix(content, "#") || strings.HasPrefix(content, "%") {
+			continue
+		}
+		if content == "---" || strings.HasPrefix(content, "--- ") || content == "..." {
+			if started && indent == 0 {
+				break
+			}
+			continue
+		}
+		started = true
+		for strings.HasPrefix(content, "- ") || content == "-" {
+			// a sibling item closes the previous one, the key it
+			// belongs to can be at its same indentation.
+			i := len(stack)
+			for i > 0 && (stack[i-1].indent > indent || stack[i-1].item && stack[i-1].indent == indent) {
+				i--
+			}
+			stack = stack[:i]
+			path := ""
+			if i > 0 {
+				parent := stack[i-1]
+				path = parent.path + "/" + strconv.Itoa(parent.items)
+				parent.items++
+			}
+			lines[path] = n
+			stack = append(stack, &yamlNode{indent: indent, item: true, path: path})
+			rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+		m := yamlKey.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		i := len(stack)
+		for i > 0 && stack[i-1].indent >= indent {
+			i--
+		}
+		stack = stack[:i]
+		key := strings.Trim(m[1], `"'`)
+		path := key
+		if i > 0 {
+			path = stack[i-1].path + "/" + key
+		}
+		if _, ok := lines[path]; !ok {
+			lines[path] = n
+		}
+		stack = append(stack, &yamlNode{indent: indent, path: path})
+		if blockScalar.MatchString(content[len(m[0]):]) {
+			scalar = indent
+		}
+	}
+	return lines
+}
+
+// locate records in the blocks and functions of the config where in data,
+// the config called name, they are given.
+func (f *functionsMeta) locate(name string, data []byte) {
+	lines := scanLines(data)
+	at := func(path string) string {
+		if n, ok := lines[path]; ok {
+			return name + ":" + strconv.Itoa(n)
+		}
+		return ""
+	}
+	for i := range f.Ex {
+		f.Ex[i].locate(at, "functions/"+strconv.Itoa(i))
+	}
+	for p, blocks := range f.Pipelines {
+		for i := range blocks {
+			blocks[i].locate(at, "pipelines/"+p+"/"+strconv.Itoa(i))
+		}
+	}
+	for n, t := range f.Templates {
+		t.locate(at, "templates/"+n)
+		f.Templates[n] = t
+	}
+}
+
+// locate records the position of the block, found at path, and its
+// functions.
+func (e *execdataMeta) locate(at func(path string) string, path string) {
+	e.pos = at(path)
+	for j := range e.Funcs {
+		e.Funcs[j].pos = at(path + "/execdata/" + strconv.Itoa(j))
+	}
+}
+
+// errorAt returns an error formatted as fmt.Errorf does, prefixed by pos if
+// it is known.
+func errorAt(pos, format string, a ...interface{}) error {
+	err := fmt.Errorf(format, a...)
+	if pos == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", pos, err)
+}
+
+var (
+	// yamlLine matches the line yaml reports an error at.
+	yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+	// unknownField matches the error strict decoding gives for unknown
+	// keys.
+	unknownField = regexp.MustCompile(`field (\S+) not found in type main\.(\w+)`)
+)
+
+// metaNames are the names of the parts of a config in decoding errors.
+var metaNames = map[string]string{
+	"functionsMeta": "the config",
+	"execdataMeta":  "block",
+	"functionMeta":  "function",
+	"templateMeta":  "template",
+	"convergeMeta":  "converge",
+	"filterMeta":    "filter",
+	"proxyMeta":     "proxy",
+}
+
+// decodeError returns err, given decoding the config name, with every
+// problem on a line of its own located at its file and line.
+func decodeError(name string, err error) error {
+	msgs := []string{err.Error()}
+	if e, ok := err.(*yaml.TypeError); ok {
+		msgs = append([]string(nil), e.Errors...)
+	}
+	for i, m := range msgs {
+		l := yamlLine.FindStringSubmatch(m)
+		if l == nil {
+			return fmt.Errorf("Error decoding yaml file %s: %v", name, err)
+		}
+		m = unknownField.ReplaceAllStringFunc(m[len(l[0]):], func(s string) string {
+			f := unknownField.FindStringSubmatch(s)
+			what, ok := metaNames[f[2]]
+			if !ok {
+				what = f[2]
+			}
+			return fmt.Sprintf("unknown key %s in %s", f[1], what)
+		})
+		msgs[i] = name + ":" + l[1] + ": " + m
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanLines(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]int
+	}{
+		{
+			name: "nested sequences",
+			yaml: `functions:
+  - name: a
+    execdata:
+      - cmd: echo
+      - cmd: ls
+  - name: b
+`,
+			want: map[string]int{
+				"functions":                  1,
+				"functions/0":                2,
+				"functions/0/name":           2,
+				"functions/0/execdata":       3,
+				"functions/0/execdata/0":     4,
+				"functions/0/execdata/0/cmd": 4,
+				"functions/0/execdata/1":     5,
+				"functions/0/execdata/1/cmd": 5,
+				"functions/1":                6,
+				"functions/1/name":           6,
+			},
+		},
+		{
+			name: "sequences at the indentation of their key",
+			yaml: `functions:
+- name: a
+  execdata:
+  - cmd: echo
+  - - nested
+    - x
+`,
+			want: map[string]int{
+				"functions":                  1,
+				"functions/0":                2,
+				"functions/0/name":           2,
+				"functions/0/execdata":       3,
+				"functions/0/execdata/0":     4,
+				"functions/0/execdata/0/cmd": 4,
+				"functions/0/execdata/1":     5,
+				"functions/0/execdata/1/0":   5,
+				"functions/0/execdata/1/1":   6,
+			},
+		},
+		{
+			name: "block scalars",
+			yaml: `vars:
+  s: |
+    key: not a key
+    - not an item
+  t: x
+functions:
+  - script: >-
+      echo
+      a: b
+    name: c
+`,
+			want: map[string]int{
+				"vars":               1,
+				"vars/s":             2,
+				"vars/t":             5,
+				"functions":          6,
+				"functions/0":        7,
+				"functions/0/script": 7,
+				"functions/0/name":   10,
+			},
+		},
+		{
+			name: "quoted keys and flow style",
+			yaml: `"quoted key": 1
+'single': 2
+functions: [{name: a}]
+after: {a: 1}
+`,
+			want: map[string]int{
+				"quoted key": 1,
+				"single":     2,
+				"functions":  3,
+				"after":      4,
+			},
+		},
+		{
+			name: "comments and documents",
+			yaml: `# comment
+---
+a: 1
+  # indented comment
+---
+b: 2
+`,
+			want: map[string]int{"a": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanLines([]byte(tt.yaml)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scanLines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,84 +3,213 @@
 // license that can be found in the LICENSE file.
 
 // parexec executes shell commands sequentially and in parallel given a yaml
-// resource description.
+// resource description. The execution engine lives in package exec, parexec
+// turns the yaml description into groups of tasks for it.
 
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os/exec"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"github.com/jordilin/parexec/exec"
 )
 
-type cli struct {
-	command string
-	args    []string
+type execdataMeta struct {
+	Name  string         `yaml:"name,omitempty"`
+	Funcs []functionMeta `yaml:"execdata,omitempty"`
+	// BlockTimeout limits the time all the functions of the block take
+	// together.
+	BlockTimeout duration `yaml:"block_timeout,omitempty"`
+	// Converge retries the block until it succeeds.
+	Converge *convergeMeta `yaml:"converge,omitempty"`
+	// OnError is stop, the default, to skip the remaining functions once
+	// one fails, or continue to run them anyway.
+	OnError string `yaml:"on_error,omitempty"`
+	// Needs lists the names of the blocks that have to succeed before this
+	// one starts.
+	Needs []string `yaml:"needs,omitempty"`
+	// Expect lists what the block expects of its environment, verified
+	// before it starts.
+	Expect []expectMeta `yaml:"expect,omitempty"`
+	// Extends names the template the block is made from, With gives values
+	// to its parameters.
+	Extends string            `yaml:"extends,omitempty"`
+	With    map[string]string `yaml:"with,omitempty"`
+	// Matrix makes the block one block per combination of the values of
+	// its keys, which its strings refer to as ${key}.
+	Matrix    map[string][]string `yaml:"matrix,omitempty"`
+	blockInfo `yaml:",inline"`
+	envMeta   `yaml:",inline"`
+
+	// pos is where the block is given, file:line, if known.
+	pos string
 }
 
-type execfunc func() error
+// expectMeta is something a block expects, the output of a command or the
+// value of an environment variable of the block, see exec.Check.
+type expectMeta struct {
+	Name string   `yaml:"name,omitempty"`
+	Cmd  string   `yaml:"cmd,omitempty"`
+	Args []string `yaml:"args,omitempty"`
+	Var  string   `yaml:"var,omitempty"`
+	Want string   `yaml:"want,omitempty"`
 
-func readYaml(path string) ([]byte, error) {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return content, err
-	}
-	return content, nil
+	// base is the directory of the config the expectation is given in, see
+	// functionMeta.
+	base string
 }
 
-type execdataMeta struct {
-	Funcs []functionMeta `yaml:"execdata"`
+// filterMeta describes what the console shows of the output of a function,
+// see exec.Filter.
+type filterMeta struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	Strip   string   `yaml:"strip,omitempty"`
+	JSON    bool     `yaml:"json,omitempty"`
 }
 
-type functionMeta struct {
-	Name string   `yaml:"name"`
-	Cmd  string   `yaml:"cmd"`
-	Args []string `yaml:"args"`
+// filter returns the exec filter f describes, nil if f is.
+func (f *filterMeta) filter() *exec.Filter {
+	if f == nil {
+		return nil
+	}
+	return &exec.Filter{Include: f.Include, Exclude: f.Exclude, Strip: f.Strip, JSON: f.JSON}
 }
 
-type functionsMeta struct {
-	Ex []execdataMeta `yaml:"functions"`
+// convergeMeta describes how a block is retried until it succeeds, see
+// exec.Converge.
+type convergeMeta struct {
+	Interval    duration `yaml:"interval,omitempty"`
+	MaxInterval duration `yaml:"max_interval,omitempty"`
+	Deadline    duration `yaml:"deadline,omitempty"`
+	Jitter      float64  `yaml:"jitter,omitempty"`
 }
 
-// execData encapsulates functions that need to be executed. It can contain an
-// array of functions that execute one after another, i.e second function
-// depends on the outcome of the first to be able to execute.
-type execData struct {
-	fs []execfunc
-}
+type functionMeta struct {
+	Name string   `yaml:"name,omitempty"`
+	Cmd  string   `yaml:"cmd,omitempty"`
+	Args []string `yaml:"args,omitempty"`
+	// Shell runs cmd and args, joined by spaces, through the shell, so they
+	// can use pipes, globs and the like. Script runs a script through the
+	// shell instead of cmd, args being its positional parameters.
+	Shell  bool   `yaml:"shell,omitempty"`
+	Script string `yaml:"script,omitempty"`
+	// ShellPath is the shell Shell and Script use, overriding the one of
+	// the config.
+	ShellPath string `yaml:"shell_path,omitempty"`
+	// Dir is the directory the command runs in, relative to the one of
+	// the config. A relative command is relative to it too, or to the
+	// directory of the config without it.
+	Dir string `yaml:"dir,omitempty"`
+	// MaxLinesPerSec limits the output lines per second shown on the
+	// console, overriding -max-lines-per-sec.
+	MaxLinesPerSec int `yaml:"max_lines_per_sec,omitempty"`
+	// RateLimit names the rate limit the start of the command counts
+	// against.
+	RateLimit string `yaml:"ratelimit,omitempty"`
+	// Timeout limits the time the command runs.
+	Timeout duration `yaml:"timeout,omitempty"`
+	// Retries is the number of times a failed command is run again before
+	// the block is marked failed, waiting Backoff, doubled after every
+	// attempt up to MaxBackoff.
+	Retries    int      `yaml:"retries,omitempty"`
+	Backoff    duration `yaml:"backoff,omitempty"`
+	MaxBackoff duration `yaml:"max_backoff,omitempty"`
+	Jitter     float64  `yaml:"jitter,omitempty"`
+	// Stderr is interleave, the default, to print the standard error
+	// along with the standard output, separate to print it after it or
+	// discard.
+	Stderr string `yaml:"stderr,omitempty"`
+	// StdinFrom is previous to feed the output of the previous function of
+	// the block to the standard input of the command, as a shell pipe
+	// does.
+	StdinFrom string `yaml:"stdin_from,omitempty"`
+	// Log is both, the default, to write the output to the console and to
+	// the log file with -log-dir, file to only write it to the file or
+	// console to not log it.
+	Log string `yaml:"log,omitempty"`
+	// Destructive marks commands with side effects that are only run with
+	// -allow-destructive.
+	Destructive bool `yaml:"destructive,omitempty"`
+	// RehearseCmd and RehearseArgs are a read-only equivalent of the
+	// command, e.g. terraform plan for terraform apply, which -rehearse
+	// runs instead.
+	RehearseCmd  string   `yaml:"rehearse_cmd,omitempty"`
+	RehearseArgs []string `yaml:"rehearse_args,omitempty"`
+	// When and Unless are conditions the function only runs if the first
+	// is true and the second false, see exec.Task.When.
+	When   string `yaml:"when,omitempty"`
+	Unless string `yaml:"unless,omitempty"`
+	// Output lists where the output goes, overriding log: console, file
+	// for the log file with -log-dir, events for output events with
+	// -output jsonl, http and https URLs it is posted to, or discard alone to
+	// drop it.
+	Output []string `yaml:"output,omitempty"`
+	// Filter changes what the console shows of the output, see
+	// exec.Filter.
+	Filter  *filterMeta `yaml:"filter,omitempty"`
+	envMeta `yaml:",inline"`
 
-func newexecData() *execData {
-	return &execData{}
+	// pos is where the function is given, file:line, if known.
+	pos string
+	// base is the directory of the config the function is given in, which
+	// its relative dir and command are relative to. Empty means the current
+	// directory.
+	base string
+	// templated is set if the command line refers to the steps before
+	// the function, see exec.Task.Templated.
+	templated bool
 }
 
-func (e *execData) add(fs execfunc) {
-	e.fs = append(e.fs, fs)
-}
+type functionsMeta struct {
+	Ex []execdataMeta `yaml:"functions,omitempty"`
+	// Pipelines defines named lists of blocks run with the run command.
+	Pipelines map[string][]execdataMeta `yaml:"pipelines,omitempty"`
+	// Templates defines block skeletons blocks extend.
+	Templates map[string]templateMeta `yaml:"templates,omitempty"`
+	// Vars defines values commands refer to as {{.name}}.
+	Vars map[string]string `yaml:"vars,omitempty"`
+	// Params declares the values given with -param, which commands refer
+	// to as vars.
+	Params map[string]paramMeta `yaml:"params,omitempty"`
+	// RateLimits defines named rate limits, e.g. github: 50/min.
+	RateLimits map[string]string `yaml:"ratelimits,omitempty"`
+	// Timeout limits the time the whole run takes.
+	Timeout duration `yaml:"timeout,omitempty"`
+	// ShellPath is the shell functions with shell or script use, /bin/sh if
+	// empty.
+	ShellPath string `yaml:"shell_path,omitempty"`
+	// Concurrency is the number of blocks executed in parallel, one per CPU
+	// if 0. -workers overrides it.
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// Include lists configs, or globs matching them, relative to this one,
+	// whose functions go before the ones of this config and whose settings
+	// it overrides.
+	Include []string `yaml:"include,omitempty"`
+	envMeta `yaml:",inline"`
 
-// executor is a worker that receives data to be executed. The data contains the
-// functions to be executed.
-// This will run inside a goroutine receiving executable data execData which
-// contains an array of functions to be executed one after another.
-func executor(edataCh <-chan *execData, wg *sync.WaitGroup) {
-	for edata := range edataCh {
-		for _, f := range edata.fs {
-			err := f()
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
-	}
-	wg.Done()
+	limiters map[string]*exec.Limiter
+	// allowDestructive runs the destructive functions instead of skipping
+	// them.
+	allowDestructive bool
+	// hash is the sha256 of the project config and the ones it includes.
+	hash string
 }
 
-// processConfig reads the config yaml of the functions that need to be
+// processConfig decodes the config yaml of the functions that need to be
 // executed. A top level functions key has an array of execdata (executable
 // data), which in turn is an array of functions that will be executed one
 // after the other. execdata blocks will be executed in parallel.
@@ -107,61 +236,440 @@ func executor(edataCh <-chan *execData, wg *sync.WaitGroup) {
 //   master /
 //          \
 //           ---> worker-1 => execute [echo "hi there", ls "."]
-func processConfig(config *string) []*execData {
-	c, err := readYaml("config.yaml")
-	if err != nil {
-		log.Fatal(err)
-	}
-	f := functionsMeta{}
-	err = yaml.Unmarshal(c, &f)
-	if err != nil {
-		log.Fatalf("Error decoding yaml file %v", err)
+//
+// Only the metadata is kept in memory, exec groups are built with newGroup as
+// they are dispatched to the workers.
+// In strict mode keys that parexec does not know about, e.g. a misspelled
+// args, are reported as errors instead of being ignored.
+// The config is read from standard input if its path is "-".
+// Several configs are combined in the order given, as the configs a config
+// includes are, see loadConfig.
+// Settings not given in the config are taken from the configs of the user and
+// the system, see layerPaths.
+// A config can also define named pipelines, each one a list of execdata
+// blocks using the settings of the config, of which pipeline is run in place
+// of the functions.
+func processConfig(configs []string, strict bool, pipeline string, params map[string]string) *functionsMeta {
+	f := &functionsMeta{}
+	for _, path := range layerPaths() {
+		l, err := decodeLayer(path, strict)
+		if err != nil {
+			fatalConfig(err)
+		}
+		if l != nil {
+			f.merge(l)
+		}
 	}
-	var dataExec []*execData
-	for _, r := range f.Ex {
-		eData := newexecData()
-		for _, f := range r.Funcs {
-			clargs := &cli{f.Cmd, f.Args}
-			fc := buildFunc(clargs)
-			eData.add(fc)
+	h := sha256.New()
+	p := &functionsMeta{}
+	for _, path := range configs {
+		c, err := loadConfig(path, strict, h, nil)
+		if err != nil {
+			fatalConfig(err)
 		}
-		dataExec = append(dataExec, eData)
+		p.combine(c)
+	}
+	f.hash = hex.EncodeToString(h.Sum(nil))
+	f.merge(p)
+	if err := f.selectPipeline(pipeline); err != nil {
+		fatalConfig(err)
+	}
+	if err := f.applyTemplates(); err != nil {
+		fatalConfig(err)
+	}
+	if err := f.expandMatrices(); err != nil {
+		fatalConfig(err)
+	}
+	if err := f.applyParams(params); err != nil {
+		fatalConfig(err)
+	}
+	if err := f.interpolate(); err != nil {
+		fatalConfig(err)
 	}
-	return dataExec
+	if err := f.assignNames(); err != nil {
+		fatalConfig(err)
+	}
+	if err := f.validate(); err != nil {
+		fatalConfig(err)
+	}
+	return f
 }
 
-// buildFunc builds a new execfunc based on configuration parameters.
-func buildFunc(clargs *cli) execfunc {
-	f := func() error {
-		fmt.Printf("executing %v\n", clargs.command)
-		cmd := exec.Command(clargs.command, clargs.args...)
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		err := cmd.Run()
-		if err != nil {
-			return err
+// Exit codes of parexec.
+const (
+	// exitFailed means some block did not succeed.
+	exitFailed = 1
+	// exitConfig means the config or the command line are wrong, nothing
+	// was run.
+	exitConfig = 2
+)
+
+// fatalConfig prints v like log.Print and exits with exitConfig.
+func fatalConfig(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitConfig)
+}
+
+// fatalConfigf prints v like log.Printf and exits with exitConfig.
+func fatalConfigf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitConfig)
+}
+
+// isFlagSet reports whether the flag name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		fmt.Println(out.String())
-		return nil
+	})
+	return set
+}
+
+// configGroups provides the blocks of a config as exec groups, in the order
+// given by idx.
+type configGroups struct {
+	fm  *functionsMeta
+	idx []int
+	// base is the environment functions start from.
+	base []string
+}
+
+func (c *configGroups) Len() int {
+	return len(c.idx)
+}
+
+func (c *configGroups) Group(i int) *exec.Group {
+	return newGroup(c.fm.Ex[c.idx[i]], c.fm, c.base)
+}
+
+func (c *configGroups) GroupName(i int) string {
+	return c.fm.Ex[c.idx[i]].Name
+}
+
+func (c *configGroups) GroupNeeds(i int) []string {
+	return c.fm.Ex[c.idx[i]].Needs
+}
+
+func (c *configGroups) GroupInfo(i int) exec.Info {
+	return exec.Info(c.fm.Ex[c.idx[i]].blockInfo)
+}
+
+// newGroup builds an exec group out of the metadata of a block. fm is the
+// config the block belongs to and base the environment its functions start
+// from.
+func newGroup(r execdataMeta, fm *functionsMeta, base []string) *exec.Group {
+	g := &exec.Group{
+		Name:    r.Name,
+		Timeout: time.Duration(r.BlockTimeout),
+		Info:    exec.Info(r.blockInfo),
+
+		ContinueOnError: r.OnError == onErrorContinue,
+		Needs:           r.Needs,
 	}
-	return f
+	if c := r.Converge; c != nil {
+		g.Converge = &exec.Converge{
+			Interval:    time.Duration(c.Interval),
+			MaxInterval: time.Duration(c.MaxInterval),
+			Deadline:    time.Duration(c.Deadline),
+			Jitter:      c.Jitter,
+		}
+	}
+	g.Checks = r.checks(fm, base)
+	for _, f := range r.Funcs {
+		em := fm.envMeta.merge(r.envMeta).merge(f.envMeta)
+		cmd, args := f.commandLine(fm.ShellPath)
+		if f.Dir == "" && !f.templated && strings.ContainsRune(cmd, filepath.Separator) {
+			// with a dir the command is relative to it.
+			cmd = rebase(f.base, cmd)
+		}
+		t := &exec.Task{
+			Name:           f.Name,
+			Cmd:            em.lookPath(cmd),
+			Args:           args,
+			Env:            em.environ(base),
+			Dir:            rebase(f.base, f.Dir),
+			MaxLinesPerSec: f.MaxLinesPerSec,
+			Limiter:        fm.limiters[f.RateLimit],
+			Timeout:        time.Duration(f.Timeout),
+			Retries:        f.Retries,
+			Backoff:        time.Duration(f.Backoff),
+			MaxBackoff:     time.Duration(f.MaxBackoff),
+			Jitter:         f.Jitter,
+			Stderr:         exec.StderrMode(f.Stderr),
+			Log:            exec.LogMode(f.Log),
+			Output:         f.Output,
+			Filter:         f.Filter.filter(),
+
+			StdinFromPrevious: f.StdinFrom == stdinPrevious,
+
+			When:   f.When,
+			Unless: f.Unless,
+		}
+		if f.templated {
+			t.Templated = true
+		}
+		if f.templated || f.When != "" || f.Unless != "" {
+			t.Vars = fm.Vars
+		}
+		if f.Destructive && !fm.allowDestructive {
+			t.Blocked = safeMode
+		}
+		g.Tasks = append(g.Tasks, t)
+	}
+	return g
 }
 
 func main() {
-	config := flag.String("config", "config.yaml", "path to the config.yaml file")
+	var configs configFlag
+	flag.Var(&configs, "config", "path to the config file, - for standard input; by default the nearest "+projectConfig+" in the current directory or above it, or else "+defaultConfig+"; can be repeated to combine several configs")
+	flag.Var(&configs, "f", "shorthand for -config")
+	workers := flag.Int("workers", 0, "number of blocks executed in parallel, 0 for the concurrency of the config or one per CPU")
+	queueSize := flag.Int("queue-size", runtime.NumCPU(), "maximum number of batches waiting for a worker")
+	batch := flag.Int("batch", 1, "number of blocks handed to a worker at once")
+	stats := flag.Bool("stats", false, "print scheduling statistics at the end of the run")
+	order := flag.String("order", orderConfig, "order blocks are dispatched in: config, shuffle or name")
+	seed := flag.Int64("seed", 0, "seed used to shuffle blocks, a random one is picked if 0")
+	strict := flag.Bool("strict", true, "fail on unknown keys in the config, -strict=false to ignore them")
+	hexdump := flag.Bool("hexdump", false, "print the first bytes of binary output that is suppressed")
+	runID := flag.String("run-id", "", "id of the run, a new ULID is generated if empty")
+	retryBudget := flag.Int("retry-budget", -1, "maximum number of retries of the whole run, -1 for no limit")
+	maxLines := flag.Int("max-lines-per-sec", 0, "maximum output lines per second a function prints to the console, 0 for no limit")
+	allowDestructive := flag.Bool("allow-destructive", false, "run the functions marked destructive, they are skipped otherwise")
+	keepGoing := flag.Bool("keep-going", false, "keep starting blocks after one fails, by default no more are started")
+	output := flag.String("output", outputText, "output format: text, json for a report at the end or jsonl for an event per line")
+	snapshotPath := flag.String("snapshot", "", "write the resolved commands and environment of the run to this file, only readable by its owner, to reproduce it later; the environment is recorded with the values of variables named like *TOKEN*, *SECRET*, *PASSWORD* or *KEY* redacted, and replay takes them from its own")
+	debugOnFailure := flag.Bool("debug-on-failure", false, "open a shell where a function failed, then ask whether to retry it, skip the failure or abort")
+	killGrace := flag.Duration("kill-grace", 5*time.Second, "time the commands of cancelled functions have to exit after SIGTERM before they are killed")
+	step := flag.Bool("step", false, "show every command before running it and ask whether to run it, skip it or abort")
+	rehearse := flag.Bool("rehearse", false, "run the rehearse_cmd of the functions that have one instead of their command")
+	params := paramFlag{}
+	flag.Var(params, "param", "value of a param of the config, as name=value; can be repeated")
+	dryRun := flag.Bool("dry-run", false, "print what would be executed and exit without running anything")
+	grouped := flag.Bool("grouped", false, "print the output of each block as one chunk when it finishes")
+	logDir := flag.String("log-dir", "", "write the output of every function to <dir>/<block>/<function>.log")
+	ci := flag.String("ci", ciAuto, "fold the output of every block and annotate failures for a CI system: auto to detect it, "+ciGitHub+", "+ciGitLab+", "+ciBuildkite+" or "+ciNone+"; the output is then grouped when blocks run in parallel, unless -grouped=false")
+	prefix := flag.Bool("prefix", false, "start every line the commands print with the block and function they belong to, as lines arrive, or once the block finishes with -grouped")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [config.yaml]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] run <pipeline>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] replay <snapshot>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] config show [-resolved]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	eds := processConfig(config)
-	var wg sync.WaitGroup
-	workers := runtime.NumCPU()
-	wg.Add(workers)
-	edCh := make(chan *execData)
-	// spawn n workers in charge of execute execData
-	for i := 0; i < workers; i++ {
-		go executor(edCh, &wg)
-	}
-	for _, ed := range eds {
-		edCh <- ed
-	}
-	close(edCh)
-	wg.Wait()
+	args := flag.Args()
+	var pipeline, replay string
+	switch {
+	case len(args) == 2 && args[0] == "run":
+		pipeline = args[1]
+		args = nil
+	case len(args) == 2 && args[0] == "replay":
+		replay = args[1]
+		args = nil
+	}
+	if len(configs) == 0 && (len(args) == 0 || args[0] == "config") {
+		configs = configFlag{findConfig()}
+	}
+	if len(args) >= 2 && args[0] == "config" && args[1] == "show" {
+		showConfig(args[2:], configs, *strict, *workers, params)
+		return
+	}
+	switch len(args) {
+	case 0:
+	case 1:
+		if isFlagSet("config") || isFlagSet("f") {
+			fatalConfig("the config is given both as a flag and as an argument")
+		}
+		configs = configFlag{args[0]}
+	default:
+		flag.Usage()
+		os.Exit(exitConfig)
+	}
+	stdin := 0
+	for _, c := range configs {
+		if c == "-" {
+			stdin++
+		}
+	}
+	if stdin > 1 {
+		fatalConfig("standard input is given as a config more than once")
+	}
+	if *workers < 0 {
+		fatalConfigf("invalid number of workers %d", *workers)
+	}
+	if *queueSize < 0 {
+		fatalConfigf("invalid queue size %d", *queueSize)
+	}
+	if *batch < 1 {
+		fatalConfigf("invalid batch size %d", *batch)
+	}
+	if err := checkOutput(*output); err != nil {
+		fatalConfig(err)
+	}
+	markers, err := ciMarkers(*ci, os.Getenv)
+	if err != nil {
+		fatalConfig(err)
+	}
+	if *runID == "" {
+		id, err := newRunID(time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		*runID = id
+	}
+	console := exec.NewSyncWriter(os.Stdout)
+	if *output != outputText {
+		console = exec.NewSyncWriter(os.Stderr)
+	}
+	// groups come from the config, or from the snapshot of a previous run
+	// when replaying it.
+	var groups exec.Groups
+	var timeout time.Duration
+	var concurrency int
+	var hash string
+	if replay != "" {
+		if len(params) > 0 {
+			fatalConfigf("-param cannot be used with replay, the snapshot has the commands to run")
+		}
+		if *rehearse {
+			fatalConfigf("-rehearse cannot be used with replay, the snapshot has the commands to run")
+		}
+		s, err := readSnapshot(replay)
+		if err != nil {
+			fatalConfig(err)
+		}
+		fmt.Fprintf(console, "run %s, replaying run %s of %s\n", *runID, s.RunID, s.Config)
+		groups = s.groups(*allowDestructive)
+		timeout, concurrency, hash = s.Timeout, s.Concurrency, s.ConfigSHA256
+		configs = configFlag{s.Config}
+	} else {
+		fm := processConfig(configs, *strict, pipeline, params)
+		fm.allowDestructive = *allowDestructive
+		for _, w := range fm.unusedSinks(*logDir != "", *output == outputJSONL) {
+			fmt.Fprintln(console, w)
+		}
+		if *rehearse {
+			fm.rehearse()
+			fmt.Fprintf(console, "run %s, rehearsing\n", *runID)
+		} else {
+			fmt.Fprintf(console, "run %s\n", *runID)
+		}
+		if *order == orderShuffle && *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		idx, err := blockOrder(fm.Ex, *order, *seed)
+		if err != nil {
+			fatalConfig(err)
+		}
+		if *order == orderShuffle {
+			fmt.Fprintf(console, "shuffling blocks with -seed %d\n", *seed)
+		}
+		groups = &configGroups{
+			fm:   fm,
+			idx:  idx,
+			base: append(os.Environ(), runIDEnv+"="+*runID),
+		}
+		timeout, concurrency, hash = time.Duration(fm.Timeout), fm.Concurrency, fm.hash
+	}
+	ctx, cancel := exec.WithCancelReason(context.Background())
+	defer cancel("run finished")
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = exec.WithTimeoutReason(ctx, timeout,
+			fmt.Sprintf("run timeout of %v exceeded", timeout))
+		defer cancelTimeout()
+	}
+	r := exec.NewRunner()
+	switch {
+	case *workers > 0:
+		r.Workers = *workers
+	case concurrency > 0:
+		r.Workers = concurrency
+	}
+	r.QueueSize = *queueSize
+	r.Batch = *batch
+	r.Out = console
+	r.Grouped = *grouped
+	r.Prefix = *prefix
+	r.LogDir = *logDir
+	r.HexDump = *hexdump
+	r.MaxLinesPerSec = *maxLines
+	r.RetryBudget = *retryBudget
+	r.StopOnFailure = !*keepGoing
+	r.RunID = *runID
+	r.KillGrace = *killGrace
+	if markers != nil {
+		r.Markers = markers
+		// markers of blocks running at the same time would mix.
+		if !isFlagSet("grouped") && r.Workers > 1 {
+			r.Grouped = true
+		}
+	}
+	if *output == outputJSONL {
+		r.Events = jsonEvents(os.Stdout)
+	}
+	if *debugOnFailure || *step {
+		p := newPrompter(console, cancel)
+		if *debugOnFailure {
+			r.OnFailure = p.onFailure
+		}
+		if *step {
+			r.Step = p.onStep
+		}
+	}
+	if *dryRun {
+		printPlan(console, groups, r.Workers)
+		return
+	}
+	if *snapshotPath != "" {
+		s := newSnapshot(*runID, configs.String(), hash, groups)
+		s.ConfigDirs = configDirs(configs)
+		s.Timeout, s.Concurrency = timeout, concurrency
+		if err := writeSnapshot(*snapshotPath, s); err != nil {
+			log.Fatal(err)
+		}
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if sig, ok := <-interrupted; ok {
+			fmt.Fprintf(console, "%v received, cancelling the run, again to kill the running commands\n", sig)
+			name := "SIGTERM"
+			if sig == os.Interrupt {
+				name = "SIGINT"
+			}
+			cancel("interrupted by " + name)
+		}
+		if sig, ok := <-interrupted; ok {
+			fmt.Fprintf(console, "%v received, killing the running commands\n", sig)
+			// a third signal terminates parexec right away.
+			signal.Stop(interrupted)
+			r.Kill()
+		}
+	}()
+	st := r.Run(ctx, groups)
+	signal.Stop(interrupted)
+	close(interrupted)
+	if *stats {
+		st.Print(console)
+	}
+	switch *output {
+	case outputText:
+		st.Summary(console)
+	case outputJSON:
+		rep := newReport(*runID, st)
+		rep.Results = st.Results()
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	case outputJSONL:
+		rep := newReport(*runID, st)
+		rep.Event = "end"
+		json.NewEncoder(os.Stdout).Encode(rep)
+	}
+	if !st.OK() {
+		os.Exit(exitFailed)
+	}
 }
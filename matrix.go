@@ -0,0 +1,95 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// matrixKey matches the valid keys of a matrix.
+var matrixKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandMatrices replaces every block with a matrix by one block per
+// combination of its values, run in parallel. The strings of each refer to
+// the values as ${key}, as they do to the parameters of templates. Copies of
+// a named block are called after the values, e.g. test[1.13], unless the
+// name refers to them, and needing the block means needing every copy. The
+// copies share the names of their functions, as any two blocks can.
+func (f *functionsMeta) expandMatrices() error {
+	var ex []execdataMeta
+	copies := make(map[string][]string)
+	for i, r := range f.Ex {
+		if r.Matrix == nil {
+			ex = append(ex, r)
+			continue
+		}
+		ref := r.Name
+		if ref == "" {
+			ref = fmt.Sprintf("block-%d", i)
+		}
+		keys := make([]string, 0, len(r.Matrix))
+		for k, values := range r.Matrix {
+			if !matrixKey.MatchString(k) {
+				return errorAt(r.pos, "block %s: invalid matrix key %q", ref, k)
+			}
+			if len(values) == 0 {
+				return errorAt(r.pos, "block %s: matrix key %s has no values", ref, k)
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			return errorAt(r.pos, "block %s: matrix has no keys", ref)
+		}
+		sort.Strings(keys)
+		for _, combo := range combinations(keys, r.Matrix) {
+			pairs := make([]string, 0, 2*len(keys))
+			for j, k := range keys {
+				pairs = append(pairs, "${"+k+"}", combo[j])
+			}
+			m := r.expand(strings.NewReplacer(pairs...).Replace)
+			m.Matrix = nil
+			if r.Name != "" && m.Name == r.Name {
+				m.Name = r.Name + "[" + strings.Join(combo, ",") + "]"
+			}
+			if r.Name != "" {
+				copies[r.Name] = append(copies[r.Name], m.Name)
+			}
+			ex = append(ex, m)
+		}
+	}
+	for i := range ex {
+		r := &ex[i]
+		var needs []string
+		for _, n := range r.Needs {
+			if c, ok := copies[n]; ok {
+				needs = append(needs, c...)
+				continue
+			}
+			needs = append(needs, n)
+		}
+		r.Needs = needs
+	}
+	f.Ex = ex
+	return nil
+}
+
+// combinations returns every combination of the values of the keys of
+// matrix, in order, with the values of the last key changing first.
+func combinations(keys []string, matrix map[string][]string) [][]string {
+	combos := [][]string{nil}
+	for _, k := range keys {
+		var next [][]string
+		for _, c := range combos {
+			for _, v := range matrix[k] {
+				next = append(next, append(c[:len(c):len(c)], v))
+			}
+		}
+		combos = next
+	}
+	return combos
+}
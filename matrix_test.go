@@ -0,0 +1,139 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCombinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []string
+		matrix map[string][]string
+		want   [][]string
+	}{
+		{
+			name:   "one key",
+			keys:   []string{"go"},
+			matrix: map[string][]string{"go": {"1.12", "1.13"}},
+			want:   [][]string{{"1.12"}, {"1.13"}},
+		},
+		{
+			name:   "last key changes first",
+			keys:   []string{"go", "os"},
+			matrix: map[string][]string{"go": {"1.12", "1.13"}, "os": {"linux", "darwin"}},
+			want: [][]string{
+				{"1.12", "linux"}, {"1.12", "darwin"},
+				{"1.13", "linux"}, {"1.13", "darwin"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combinations(tt.keys, tt.matrix); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("combinations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandMatrices(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want lists the blocks after expanding, as name: arg of their
+		// first function, and needs the needs of each.
+		want  []string
+		needs [][]string
+		err   string
+	}{
+		{
+			name: "copies named after the values",
+			yaml: `
+functions:
+  - name: test
+    matrix: {go: ["1.12", "1.13"], os: [linux]}
+    execdata:
+      - cmd: echo
+        args: ["${go}-${os}"]
+  - name: after
+    needs: [test]
+    execdata:
+      - cmd: echo
+        args: [done]
+`,
+			want:  []string{"test[1.12,linux]: 1.12-linux", "test[1.13,linux]: 1.13-linux", "after: done"},
+			needs: [][]string{nil, nil, {"test[1.12,linux]", "test[1.13,linux]"}},
+		},
+		{
+			name: "names referring to the values",
+			yaml: `
+functions:
+  - name: test-${go}
+    matrix: {go: ["1.12", "1.13"]}
+    execdata:
+      - cmd: echo
+        args: ["${go}"]
+`,
+			want:  []string{"test-1.12: 1.12", "test-1.13: 1.13"},
+			needs: [][]string{nil, nil},
+		},
+		{
+			name: "invalid key",
+			yaml: `
+functions:
+  - name: test
+    matrix: {"go-version": ["1.12"]}
+    execdata:
+      - cmd: echo
+`,
+			err: `invalid matrix key "go-version"`,
+		},
+		{
+			name: "key without values",
+			yaml: `
+functions:
+  - name: test
+    matrix: {go: []}
+    execdata:
+      - cmd: echo
+`,
+			err: "matrix key go has no values",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := decodeConfig(strings.NewReader(tt.yaml), "test.yaml", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.expandMatrices()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expandMatrices() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var needs [][]string
+			for _, r := range f.Ex {
+				got = append(got, r.Name+": "+strings.Join(r.Funcs[0].Args, " "))
+				needs = append(needs, r.Needs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blocks = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(needs, tt.needs) {
+				t.Errorf("needs = %q, want %q", needs, tt.needs)
+			}
+		})
+	}
+}
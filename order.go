@@ -0,0 +1,42 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Dispatch orders of the execdata blocks.
+const (
+	orderConfig  = "config"
+	orderShuffle = "shuffle"
+	orderName    = "name"
+)
+
+// blockOrder returns the indexes of the blocks in ex in the order they have to
+// be dispatched. Shuffling uses seed, so a run can be reproduced by passing
+// the same seed again.
+func blockOrder(ex []execdataMeta, order string, seed int64) ([]int, error) {
+	idx := make([]int, len(ex))
+	for i := range idx {
+		idx[i] = i
+	}
+	switch order {
+	case orderConfig:
+	case orderShuffle:
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(idx), func(i, j int) { idx[i], idx[j] = idx[j], idx[i] })
+	case orderName:
+		sort.SliceStable(idx, func(i, j int) bool {
+			return ex[idx[i]].Name < ex[idx[j]].Name
+		})
+	default:
+		return nil, fmt.Errorf("unknown order %q, want one of %s, %s or %s",
+			order, orderConfig, orderShuffle, orderName)
+	}
+	return idx, nil
+}
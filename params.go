@@ -0,0 +1,198 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of params.
+const (
+	paramString = "string"
+	paramInt    = "int"
+	paramBool   = "bool"
+	paramEnum   = "enum"
+)
+
+// paramMeta declares a parameter of the config, given with -param and used by
+// commands as {{.name}}, like the vars.
+type paramMeta struct {
+	// Type is string, the default, int, bool or enum, whose values are
+	// listed by Values.
+	Type   string   `yaml:"type,omitempty"`
+	Values []string `yaml:"values,omitempty"`
+	// Default is the value of the param when it is not given, Required
+	// makes giving it mandatory instead.
+	Default  *string `yaml:"default,omitempty"`
+	Required bool    `yaml:"required,omitempty"`
+	Help     string  `yaml:"help,omitempty"`
+}
+
+// paramFlag holds the values of the repeated -param name=value flag.
+type paramFlag map[string]string
+
+func (p paramFlag) String() string {
+	pairs := make([]string, 0, len(p))
+	for k, v := range p {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p paramFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	p[s[:i]] = s[i+1:]
+	return nil
+}
+
+// check returns an error if v is not a value of the param.
+func (p paramMeta) check(v string) error {
+	switch p.Type {
+	case paramInt:
+		if _, err := strconv.Atoi(v); err != nil {
+			return fmt.Errorf("%q is not an int", v)
+		}
+	case paramBool:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%q is not a bool", v)
+		}
+	case paramEnum:
+		for _, e := range p.Values {
+			if v == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(p.Values, ", "))
+	}
+	return nil
+}
+
+// applyParams makes the params of the config, with the values given or their
+// defaults, available to commands as vars. Params that are not given and have
+// no default are empty, or false if they are bools. Values are checked
+// against the declarations, and the error returned when they do not match
+// ends with the usage of the params.
+func (f *functionsMeta) applyParams(given map[string]string) error {
+	if err := f.checkParams(); err != nil {
+		return err
+	}
+	var errs []string
+	for _, name := range f.paramNames() {
+		p := f.Params[name]
+		v, ok := given[name]
+		switch {
+		case ok:
+			if err := p.check(v); err != nil {
+				errs = append(errs, fmt.Sprintf("param %s: %v", name, err))
+				continue
+			}
+		case p.Default != nil:
+			v = *p.Default
+		case p.Required:
+			errs = append(errs, fmt.Sprintf("param %s is required", name))
+			continue
+		case p.Type == paramBool:
+			v = "false"
+		}
+		if p.Type == paramBool {
+			// templates see true or false however it was given.
+			b, _ := strconv.ParseBool(v)
+			v = strconv.FormatBool(b)
+		}
+		if f.Vars == nil {
+			f.Vars = make(map[string]string)
+		}
+		f.Vars[name] = v
+	}
+	for name := range given {
+		if _, ok := f.Params[name]; !ok {
+			errs = append(errs, fmt.Sprintf("unknown param %s", name))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s\n%s", strings.Join(errs, "\n"), f.paramUsage())
+	}
+	return nil
+}
+
+// checkParams returns an error if the declarations of the params are wrong.
+func (f *functionsMeta) checkParams() error {
+	for _, name := range f.paramNames() {
+		p := f.Params[name]
+		switch p.Type {
+		case "", paramString, paramInt, paramBool:
+			if len(p.Values) > 0 {
+				return fmt.Errorf("param %s: values are only given for enums", name)
+			}
+		case paramEnum:
+			if len(p.Values) == 0 {
+				return fmt.Errorf("param %s: enum without values", name)
+			}
+		default:
+			return fmt.Errorf("param %s: type must be %s, %s, %s or %s", name, paramString, paramInt, paramBool, paramEnum)
+		}
+		if p.Default != nil {
+			if p.Required {
+				return fmt.Errorf("param %s: a required param cannot have a default", name)
+			}
+			if err := p.check(*p.Default); err != nil {
+				return fmt.Errorf("param %s: default %v", name, err)
+			}
+		}
+		if _, ok := f.Vars[name]; ok {
+			return fmt.Errorf("param %s: there is a var with the same name", name)
+		}
+	}
+	return nil
+}
+
+// paramUsage returns how to give the params of the config.
+func (f *functionsMeta) paramUsage() string {
+	var b strings.Builder
+	b.WriteString("params:")
+	for _, name := range f.paramNames() {
+		p := f.Params[name]
+		kind := p.Type
+		switch kind {
+		case "":
+			kind = paramString
+		case paramEnum:
+			kind = strings.Join(p.Values, "|")
+		}
+		fmt.Fprintf(&b, "\n  -param %s=<%s>", name, kind)
+		var notes []string
+		if p.Help != "" {
+			notes = append(notes, p.Help)
+		}
+		switch {
+		case p.Required:
+			notes = append(notes, "required")
+		case p.Default != nil:
+			notes = append(notes, fmt.Sprintf("default %q", *p.Default))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(&b, "\n    \t%s", strings.Join(notes, ", "))
+		}
+	}
+	return b.String()
+}
+
+// paramNames returns the names of the params, sorted.
+func (f *functionsMeta) paramNames() []string {
+	names := make([]string, 0, len(f.Params))
+	for n := range f.Params {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
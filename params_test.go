@@ -0,0 +1,150 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParamCheck(t *testing.T) {
+	tests := []struct {
+		param paramMeta
+		value string
+		ok    bool
+	}{
+		{paramMeta{}, "anything", true},
+		{paramMeta{Type: paramString}, "", true},
+		{paramMeta{Type: paramInt}, "42", true},
+		{paramMeta{Type: paramInt}, "4.2", false},
+		{paramMeta{Type: paramBool}, "true", true},
+		{paramMeta{Type: paramBool}, "0", true},
+		{paramMeta{Type: paramBool}, "yes", false},
+		{paramMeta{Type: paramEnum, Values: []string{"dev", "prod"}}, "prod", true},
+		{paramMeta{Type: paramEnum, Values: []string{"dev", "prod"}}, "staging", false},
+	}
+	for _, tt := range tests {
+		if err := tt.param.check(tt.value); (err == nil) != tt.ok {
+			t.Errorf("%s param check(%q) = %v, want ok %v", tt.param.Type, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name   string
+		params map[string]paramMeta
+		vars   map[string]string
+		err    string
+	}{
+		{
+			name: "valid",
+			params: map[string]paramMeta{
+				"env":   {Type: paramEnum, Values: []string{"dev", "prod"}, Default: str("dev")},
+				"count": {Type: paramInt, Required: true},
+			},
+		},
+		{
+			name:   "values of a string",
+			params: map[string]paramMeta{"p": {Values: []string{"a"}}},
+			err:    "param p: values are only given for enums",
+		},
+		{
+			name:   "enum without values",
+			params: map[string]paramMeta{"p": {Type: paramEnum}},
+			err:    "param p: enum without values",
+		},
+		{
+			name:   "unknown type",
+			params: map[string]paramMeta{"p": {Type: "float"}},
+			err:    "param p: type must be",
+		},
+		{
+			name:   "required with a default",
+			params: map[string]paramMeta{"p": {Required: true, Default: str("x")}},
+			err:    "param p: a required param cannot have a default",
+		},
+		{
+			name:   "invalid default",
+			params: map[string]paramMeta{"p": {Type: paramInt, Default: str("x")}},
+			err:    `param p: default "x" is not an int`,
+		},
+		{
+			name:   "same name as a var",
+			params: map[string]paramMeta{"p": {}},
+			vars:   map[string]string{"p": "x"},
+			err:    "param p: there is a var with the same name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &functionsMeta{Params: tt.params, Vars: tt.vars}
+			err := f.checkParams()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("checkParams() = %v, want no error", err)
+			case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+				t.Errorf("checkParams() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApplyParams(t *testing.T) {
+	str := func(s string) *string { return &s }
+	params := map[string]paramMeta{
+		"env":     {Type: paramEnum, Values: []string{"dev", "prod"}, Default: str("dev")},
+		"verbose": {Type: paramBool},
+		"name":    {},
+	}
+	tests := []struct {
+		name  string
+		given map[string]string
+		want  map[string]string
+		err   string
+	}{
+		{
+			name:  "defaults",
+			given: map[string]string{},
+			want:  map[string]string{"env": "dev", "verbose": "false", "name": ""},
+		},
+		{
+			name:  "given",
+			given: map[string]string{"env": "prod", "verbose": "1", "name": "x"},
+			want:  map[string]string{"env": "prod", "verbose": "true", "name": "x"},
+		},
+		{
+			name:  "invalid value",
+			given: map[string]string{"env": "staging"},
+			err:   `param env: "staging" is not one of dev, prod`,
+		},
+		{
+			name:  "unknown param",
+			given: map[string]string{"other": "x"},
+			err:   "unknown param other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &functionsMeta{Params: params}
+			err := f.applyParams(tt.given)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("applyParams() = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if f.Vars[k] != v {
+					t.Errorf("var %s = %q, want %q", k, f.Vars[k], v)
+				}
+			}
+		})
+	}
+}
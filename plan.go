@@ -0,0 +1,134 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// printPlan writes to w what running groups on the given number of workers
+// would execute, without executing anything: the groups in the order they
+// are dispatched and the exact command line and environment of every task.
+// The environment is shown as the variables that differ from the one of
+// parexec.
+func printPlan(w io.Writer, groups exec.Groups, workers int) {
+	n := groups.Len()
+	fmt.Fprintf(w, "plan: %d blocks, up to %d at a time\n", n, workers)
+	for i := 0; i < n; i++ {
+		g := groups.Group(i)
+		fmt.Fprintf(w, "%s\n", g.Name)
+		var settings []string
+		if len(g.Needs) > 0 {
+			settings = append(settings, "needs "+strings.Join(g.Needs, ", "))
+		}
+		if g.Timeout > 0 {
+			settings = append(settings, fmt.Sprintf("timeout %v", g.Timeout))
+		}
+		if c := g.Converge; c != nil {
+			settings = append(settings, fmt.Sprintf("converge every %v for %v", c.Interval, c.Deadline))
+		}
+		if g.ContinueOnError {
+			settings = append(settings, "continue on error")
+		}
+		if len(settings) > 0 {
+			fmt.Fprintf(w, "  %s\n", strings.Join(settings, ", "))
+		}
+		for _, c := range g.Checks {
+			fmt.Fprintf(w, "  expects %s to be %q\n", c.Name, c.Want)
+		}
+		for _, t := range g.Tasks {
+			fmt.Fprintf(w, "  %s: %s\n", t.Name, exec.QuoteArgv(append([]string{t.Cmd}, t.Args...)))
+			if t.Blocked != "" {
+				fmt.Fprintf(w, "    %s\n", t.Blocked)
+			}
+			if t.Dir != "" {
+				fmt.Fprintf(w, "    dir %s\n", t.Dir)
+			}
+			if t.When != "" {
+				fmt.Fprintf(w, "    when %s\n", t.When)
+			}
+			if t.Unless != "" {
+				fmt.Fprintf(w, "    unless %s\n", t.Unless)
+			}
+			var opts []string
+			if t.Timeout > 0 {
+				opts = append(opts, fmt.Sprintf("timeout %v", t.Timeout))
+			}
+			if t.Retries > 0 {
+				opts = append(opts, fmt.Sprintf("%d retries", t.Retries))
+			}
+			if t.Stderr != "" {
+				opts = append(opts, "stderr "+string(t.Stderr))
+			}
+			if t.StdinFromPrevious {
+				opts = append(opts, "stdin from the previous function")
+			}
+			if t.Output != nil {
+				opts = append(opts, "output to "+strings.Join(t.Output, ", "))
+			}
+			if t.Filter != nil {
+				opts = append(opts, "console output filtered")
+			}
+			if len(opts) > 0 {
+				fmt.Fprintf(w, "    %s\n", strings.Join(opts, ", "))
+			}
+			base := os.Environ()
+			set, unset := envDiff(base, t.Env)
+			if len(unset) > len(base)/2 {
+				// listing most of the environment of parexec says less
+				// than this.
+				fmt.Fprintf(w, "    environment not inherited\n")
+				unset = nil
+			}
+			for _, kv := range set {
+				fmt.Fprintf(w, "    +%s\n", kv)
+			}
+			for _, k := range unset {
+				fmt.Fprintf(w, "    -%s\n", k)
+			}
+		}
+	}
+}
+
+// envDiff returns the changes that turn the environment base into env: the
+// variables set or changed, as NAME=value, and the names of the ones removed.
+// env is the environment of a task, nil meaning it inherits base.
+func envDiff(base, env []string) (set, unset []string) {
+	if env == nil {
+		return nil, nil
+	}
+	b := make(map[string]string, len(base))
+	for _, kv := range base {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			b[kv[:i]] = kv[i+1:]
+		}
+	}
+	seen := make(map[string]bool, len(env))
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		k, v := kv[:i], kv[i+1:]
+		seen[k] = true
+		if old, ok := b[k]; !ok || old != v {
+			set = append(set, kv)
+		}
+	}
+	for k := range b {
+		if !seen[k] {
+			unset = append(unset, k)
+		}
+	}
+	sort.Strings(set)
+	sort.Strings(unset)
+	return set, unset
+}
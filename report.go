@@ -0,0 +1,73 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// Values of -output. In the json modes the output of the commands goes to
+// standard error, so standard output only holds json.
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputJSONL = "jsonl"
+)
+
+func checkOutput(output string) error {
+	switch output {
+	case outputText, outputJSON, outputJSONL:
+		return nil
+	}
+	return fmt.Errorf("unknown output %q, it must be %s, %s or %s", output, outputText, outputJSON, outputJSONL)
+}
+
+// report is the outcome of a run. -output json prints it at the end of the
+// run and jsonl as its last event, without the results.
+type report struct {
+	Event  string              `json:"event,omitempty"`
+	RunID  string              `json:"run_id"`
+	OK     bool                `json:"ok"`
+	Wall   time.Duration       `json:"wall_ns"`
+	Counts map[exec.Status]int `json:"counts"`
+	// Usage is what the commands of the run consumed, GroupUsage what the
+	// ones of every group did.
+	Usage      exec.Usage            `json:"usage"`
+	GroupUsage map[string]exec.Usage `json:"group_usage"`
+	Groups     []exec.GroupResult    `json:"groups"`
+	Checks     []exec.CheckResult    `json:"checks,omitempty"`
+	Results    []exec.Result         `json:"results,omitempty"`
+}
+
+func newReport(runID string, st *exec.Stats) *report {
+	return &report{
+		RunID:  runID,
+		OK:     st.OK(),
+		Wall:   st.Wall(),
+		Counts: st.Counts(),
+
+		Usage:      st.Usage(),
+		GroupUsage: st.GroupUsage(),
+		Groups:     st.Groups(),
+		Checks:     st.Checks(),
+	}
+}
+
+// jsonEvents returns a function writing events to w as json lines.
+func jsonEvents(w io.Writer) func(exec.Event) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e exec.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"time"
+)
+
+// crockford is the base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// runIDEnv is the environment variable children find the run id in.
+const runIDEnv = "PAREXEC_RUN_ID"
+
+// newRunID returns a ULID for a run started at t: a 48 bit millisecond
+// timestamp followed by 80 random bits, encoded as 26 base32 characters. Run
+// ids sort by start time.
+func newRunID(t time.Time) (string, error) {
+	var b [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	if _, err := io.ReadFull(rand.Reader, b[6:]); err != nil {
+		return "", err
+	}
+	n := new(big.Int).SetBytes(b[:])
+	mask := big.NewInt(31)
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(id[:]), nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// snapshot records what a run executed and where, so it can be reproduced
+// later. Groups are the resolved ones, after templates are applied and
+// settings of every level merged.
+type snapshot struct {
+	RunID    string    `json:"run_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Dir      string    `json:"dir"`
+	Args     []string  `json:"args"`
+	Config   string    `json:"config"`
+	// ConfigDirs are the directories of the configs, which the relative
+	// dirs and commands they give were resolved against.
+	ConfigDirs   []string `json:"config_dirs,omitempty"`
+	ConfigSHA256 string   `json:"config_sha256"`
+	// Timeout and Concurrency are the ones of the config.
+	Timeout     time.Duration `json:"timeout_ns"`
+	Concurrency int           `json:"concurrency"`
+	// Environ is the environment of parexec, Groups holds the one of every
+	// command. The values of variables that look secret are redacted.
+	Environ []string       `json:"environ"`
+	Groups  exec.GroupList `json:"groups"`
+}
+
+// newSnapshot builds the snapshot of the run runID of the config at path,
+// whose sha256 is hash. All the groups are built at once.
+func newSnapshot(runID, path, hash string, groups exec.Groups) *snapshot {
+	s := &snapshot{
+		RunID:        runID,
+		Time:         time.Now(),
+		Args:         os.Args,
+		Config:       path,
+		ConfigSHA256: hash,
+		Environ:      redactEnv(os.Environ()),
+	}
+	s.Hostname, _ = os.Hostname()
+	s.Dir, _ = os.Getwd()
+	sort.Strings(s.Environ)
+	for i := 0; i < groups.Len(); i++ {
+		g := groups.Group(i)
+		for _, t := range g.Tasks {
+			t.Env = redactEnv(t.Env)
+		}
+		for i := range g.Checks {
+			g.Checks[i].Env = redactEnv(g.Checks[i].Env)
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s
+}
+
+// redacted replaces the values of secret variables in snapshots.
+const redacted = "[redacted]"
+
+// secretNames are the parts of the names of variables whose values are
+// secret, e.g. GITHUB_TOKEN or AWS_SECRET_ACCESS_KEY.
+var secretNames = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL"}
+
+// isSecret tells whether the variable name looks like it holds a secret.
+func isSecret(name string) bool {
+	name = strings.ToUpper(name)
+	for _, s := range secretNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactEnv returns a copy of env with the values of secret variables
+// redacted.
+func redactEnv(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	r := make([]string, len(env))
+	for i, kv := range env {
+		if j := strings.IndexByte(kv, '='); j > 0 && isSecret(kv[:j]) {
+			kv = kv[:j+1] + redacted
+		}
+		r[i] = kv
+	}
+	return r
+}
+
+// restoreEnv returns env with the redacted values taken from the environment
+// of parexec, and the variables it does not have removed.
+func restoreEnv(env []string) []string {
+	if env == nil {
+		return nil
+	}
+	r := env[:0:0]
+	for _, kv := range env {
+		if j := strings.IndexByte(kv, '='); j > 0 && kv[j+1:] == redacted {
+			v, ok := os.LookupEnv(kv[:j])
+			if !ok {
+				continue
+			}
+			kv = kv[:j+1] + v
+		}
+		r = append(r, kv)
+	}
+	return r
+}
+
+// readSnapshot reads the snapshot written to path by a previous run.
+func readSnapshot(path string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// groups returns the groups of the snapshot to run them again exactly as they
+// were, with the same commands, environment, directories and settings. Functions blocked
+// by safe mode are only run if allowDestructive. Rate limits are not
+// recorded, so they do not apply. Redacted variables get their values from
+// the environment of parexec, and are not set if it does not have them.
+func (s *snapshot) groups(allowDestructive bool) exec.Groups {
+	for _, g := range s.Groups {
+		for _, t := range g.Tasks {
+			if allowDestructive && t.Blocked == safeMode {
+				t.Blocked = ""
+			}
+			t.Env = restoreEnv(t.Env)
+			// commands run where they ran, wherever parexec is run
+			// from now.
+			if !filepath.IsAbs(t.Dir) && s.Dir != "" {
+				t.Dir = filepath.Join(s.Dir, t.Dir)
+			}
+			if !filepath.IsAbs(t.Cmd) && strings.ContainsRune(t.Cmd, filepath.Separator) && s.Dir != "" && !t.Templated {
+				t.Cmd = filepath.Join(s.Dir, t.Cmd)
+			}
+		}
+		for i := range g.Checks {
+			g.Checks[i].Env = restoreEnv(g.Checks[i].Env)
+		}
+	}
+	return s.Groups
+}
+
+// writeSnapshot writes s to path, only readable by its owner as it holds the
+// environment.
+func writeSnapshot(path string, s *snapshot) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that already exists.
+	return os.Chmod(path, 0600)
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// onStep implements exec.Runner.Step, showing the command the task of group
+// is about to run and asking whether to run it, skip it or abort the run.
+// Nothing is run once there is no one to ask.
+func (p *prompter) onStep(group string, t *exec.Task) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, "%s/%s: %s\n", group, t.Name, exec.QuoteArgv(append([]string{t.Cmd}, t.Args...)))
+	if t.Dir != "" {
+		fmt.Fprintf(p.out, "  in %s\n", t.Dir)
+	}
+	switch p.ask(group+"/"+t.Name+": [r]un, [s]kip or [a]bort?", "rsa") {
+	case 'r':
+		return true
+	case 's':
+		return false
+	}
+	p.abort("aborted at " + group + "/" + t.Name)
+	return false
+}
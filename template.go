@@ -0,0 +1,196 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// templateMeta is a block skeleton that blocks extend. Its strings can refer
+// to the parameters it declares as ${name}, which blocks give values to with
+// with.
+type templateMeta struct {
+	Params       []string `yaml:"params,omitempty"`
+	execdataMeta `yaml:",inline"`
+}
+
+// applyTemplates replaces every block that extends a template with the
+// template, its parameters replaced by the values the block gives and
+// overridden by the settings of the block.
+func (f *functionsMeta) applyTemplates() error {
+	for i := range f.Ex {
+		r := &f.Ex[i]
+		// names are only assigned later on, blocks without one are
+		// referred to by the one they will get.
+		ref := r.Name
+		if ref == "" {
+			ref = fmt.Sprintf("block-%d", i)
+		}
+		if r.Extends == "" {
+			if len(r.With) > 0 {
+				return errorAt(r.pos, "block %s: with given without extends", ref)
+			}
+			continue
+		}
+		t, ok := f.Templates[r.Extends]
+		if !ok {
+			return errorAt(r.pos, "block %s: unknown template %q, the config has: %s", ref, r.Extends,
+				strings.Join(f.templateNames(), ", "))
+		}
+		params := make(map[string]bool)
+		var pairs []string
+		for _, p := range t.Params {
+			v, ok := r.With[p]
+			if !ok {
+				return errorAt(r.pos, "block %s: template %s needs a value for %s", ref, r.Extends, p)
+			}
+			params[p] = true
+			pairs = append(pairs, "${"+p+"}", v)
+		}
+		for k := range r.With {
+			if !params[k] {
+				return errorAt(r.pos, "block %s: template %s has no parameter %s", ref, r.Extends, k)
+			}
+		}
+		*r = t.execdataMeta.expand(strings.NewReplacer(pairs...).Replace).override(*r)
+	}
+	return nil
+}
+
+// override returns the settings of e overridden by the ones o gives. o only
+// replaces the functions of e if it has any.
+func (e execdataMeta) override(o execdataMeta) execdataMeta {
+	m := e
+	m.Extends, m.With = "", nil
+	if o.Name != "" {
+		m.Name = o.Name
+	}
+	if o.pos != "" {
+		m.pos = o.pos
+	}
+	if len(o.Funcs) > 0 {
+		m.Funcs = o.Funcs
+	}
+	if o.BlockTimeout > 0 {
+		m.BlockTimeout = o.BlockTimeout
+	}
+	if o.Converge != nil {
+		m.Converge = o.Converge
+	}
+	if o.OnError != "" {
+		m.OnError = o.OnError
+	}
+	if len(o.Needs) > 0 {
+		m.Needs = o.Needs
+	}
+	if len(o.Expect) > 0 {
+		m.Expect = o.Expect
+	}
+	if len(o.Matrix) > 0 {
+		m.Matrix = o.Matrix
+	}
+	if o.Owner != "" {
+		m.Owner = o.Owner
+	}
+	if o.Docs != "" {
+		m.Docs = o.Docs
+	}
+	if o.Runbook != "" {
+		m.Runbook = o.Runbook
+	}
+	m.envMeta = e.envMeta.merge(o.envMeta)
+	return m
+}
+
+// expand returns a copy of the block with f applied to all its strings that
+// are not settings of parexec itself.
+func (e execdataMeta) expand(f func(string) string) execdataMeta {
+	m := e
+	m.Name = f(e.Name)
+	m.Funcs = make([]functionMeta, len(e.Funcs))
+	for i, fn := range e.Funcs {
+		m.Funcs[i] = fn.expand(f)
+	}
+	m.Needs = expandAll(e.Needs, f)
+	if e.Matrix != nil {
+		m.Matrix = make(map[string][]string, len(e.Matrix))
+		for k, values := range e.Matrix {
+			m.Matrix[k] = expandAll(values, f)
+		}
+	}
+	if e.Expect != nil {
+		m.Expect = make([]expectMeta, len(e.Expect))
+		for i, x := range e.Expect {
+			m.Expect[i] = x.expand(f)
+		}
+	}
+	m.Owner = f(e.Owner)
+	m.Docs = f(e.Docs)
+	m.Runbook = f(e.Runbook)
+	m.envMeta = e.envMeta.expand(f)
+	return m
+}
+
+// expand returns a copy of the function with f applied to its name, command
+// line, script, rehearsal, directory, conditions, output and environment.
+func (fn functionMeta) expand(f func(string) string) functionMeta {
+	m := fn
+	m.Name = f(fn.Name)
+	m.Cmd = f(fn.Cmd)
+	m.Args = expandAll(fn.Args, f)
+	m.Script = f(fn.Script)
+	m.RehearseCmd = f(fn.RehearseCmd)
+	m.RehearseArgs = expandAll(fn.RehearseArgs, f)
+	m.Dir = f(fn.Dir)
+	m.When = f(fn.When)
+	m.Unless = f(fn.Unless)
+	m.Output = expandAll(fn.Output, f)
+	m.envMeta = fn.envMeta.expand(f)
+	return m
+}
+
+// expand returns a copy of the settings with f applied to their values.
+func (e envMeta) expand(f func(string) string) envMeta {
+	m := e
+	m.TZ = f(e.TZ)
+	m.Locale = f(e.Locale)
+	m.Path = expandAll(e.Path, f)
+	if e.Proxy != nil {
+		p := *e.Proxy
+		p.HTTP, p.HTTPS, p.NoProxy = f(p.HTTP), f(p.HTTPS), f(p.NoProxy)
+		m.Proxy = &p
+	}
+	if e.Env != nil {
+		m.Env = make(map[string]string, len(e.Env))
+		for k, v := range e.Env {
+			m.Env[k] = f(v)
+		}
+	}
+	return m
+}
+
+// expandAll returns a copy of s with f applied to every element.
+func expandAll(s []string, f func(string) string) []string {
+	if s == nil {
+		return nil
+	}
+	r := make([]string, len(s))
+	for i, v := range s {
+		r[i] = f(v)
+	}
+	return r
+}
+
+// templateNames returns the names of the templates, sorted.
+func (f *functionsMeta) templateNames() []string {
+	names := make([]string, 0, len(f.Templates))
+	for n := range f.Templates {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
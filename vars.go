@@ -0,0 +1,261 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/jordilin/parexec/exec"
+)
+
+// envRef matches references to environment variables, ${NAME}.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// stepsRef matches templates referring to the steps before a function, which
+// can only be executed when the function is about to run.
+var stepsRef = regexp.MustCompile(`\{\{[^}]*\.steps\b`)
+
+// stepRef matches the references of conditions to a step by name.
+var stepRef = regexp.MustCompile(`(?:^|[^\w.])\.?steps\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// interpolate resolves in the commands, arguments, environment variables and
+// directories of the config the references to variables of parexec's
+// environment, ${NAME}, and the templates using the vars of the config, e.g.
+// {{.cluster}}. Scripts only get the vars, the references to variables are
+// theirs. References to variables that are not set are left as they are, so
+// the ones meant for a shell reach it, and so are templates that do not use
+// any var, so the ones meant for a command do. Using a var the config does
+// not define along with one it does is an error.
+func (f *functionsMeta) interpolate() error {
+	var err error
+	expand := func(field, s string) string {
+		if err != nil {
+			return s
+		}
+		var r string
+		r, err = f.resolve(s)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", field, err)
+		}
+		return r
+	}
+	f.Env = expandEnv(f.Env, expand)
+	if err != nil {
+		return err
+	}
+	for i := range f.Ex {
+		r := &f.Ex[i]
+		r.Env = expandEnv(r.Env, expand)
+		for j := range r.Expect {
+			e := &r.Expect[j]
+			e.Cmd = expand("expect", e.Cmd)
+			for k := range e.Args {
+				e.Args[k] = expand("expect", e.Args[k])
+			}
+			e.Want = expand("expect", e.Want)
+		}
+		for j := range r.Funcs {
+			fn := &r.Funcs[j]
+			// the templates of a command line using steps are executed
+			// as a whole once the steps have run.
+			argv := func(field, s string) string {
+				if !stepsRef.MatchString(s) {
+					return expand(field, s)
+				}
+				fn.templated = true
+				if terr := exec.CheckTemplate(s); terr != nil && err == nil {
+					err = fmt.Errorf("%s: %v", field, terr)
+				}
+				return f.resolveEnv(s, true)
+			}
+			// conditions are executed when the function is about to
+			// run too, whatever they refer to.
+			cond := func(field, s string) string {
+				if terr := exec.CheckCondition(s); terr != nil && err == nil {
+					err = fmt.Errorf("%s: %v", field, terr)
+				}
+				return f.resolveEnv(s, true)
+			}
+			// scripts have variables of their own, they only get the
+			// vars.
+			script := func(s string) string {
+				if stepsRef.MatchString(s) {
+					fn.templated = true
+					if terr := exec.CheckTemplate(s); terr != nil && err == nil {
+						err = fmt.Errorf("script: %v", terr)
+					}
+					return s
+				}
+				if err != nil {
+					return s
+				}
+				var r string
+				r, err = f.resolveVars(s)
+				if err != nil {
+					err = fmt.Errorf("script: %v", err)
+				}
+				return r
+			}
+			fn.When = cond("when", fn.When)
+			fn.Unless = cond("unless", fn.Unless)
+			fn.Cmd = argv("cmd", fn.Cmd)
+			fn.Script = script(fn.Script)
+			for k := range fn.Args {
+				fn.Args[k] = argv("args", fn.Args[k])
+			}
+			fn.RehearseCmd = expand("rehearse_cmd", fn.RehearseCmd)
+			for k := range fn.RehearseArgs {
+				fn.RehearseArgs[k] = expand("rehearse_args", fn.RehearseArgs[k])
+			}
+			fn.Dir = expand("dir", fn.Dir)
+			for k := range fn.Output {
+				fn.Output[k] = expand("output", fn.Output[k])
+			}
+			fn.Env = expandEnv(fn.Env, expand)
+		}
+		if err != nil {
+			ref := r.Name
+			if ref == "" {
+				ref = fmt.Sprintf("block-%d", i)
+			}
+			return errorAt(r.pos, "block %s: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+// resolve returns s with its references to the vars and the environment
+// resolved. The values of the environment are taken as they are, they are not
+// templates.
+func (f *functionsMeta) resolve(s string) (string, error) {
+	s, err := f.resolveVars(s)
+	if err != nil {
+		return "", err
+	}
+	return f.resolveEnv(s, false), nil
+}
+
+// resolveVars returns s with its templates executed. Templates that do not
+// refer to any var of the config are left as they are, they are meant for the
+// command, e.g. docker inspect --format {{.State.Running}}.
+func (f *functionsMeta) resolveVars(s string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		// the templates of commands can use functions of their own.
+		if !mentionsVar(s, f.Vars) {
+			return s, nil
+		}
+		return "", err
+	}
+	if !refersTo(t.Tree.Root, f.Vars) {
+		return s, nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, f.Vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// fieldRef matches the fields templates refer to, e.g. .cluster.
+var fieldRef = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)`)
+
+// mentionsVar tells whether any of the actions of s, which cannot be parsed,
+// looks like it refers to one of vars.
+func mentionsVar(s string, vars map[string]string) bool {
+	for _, a := range strings.Split(s, "{{")[1:] {
+		if i := strings.Index(a, "}}"); i >= 0 {
+			a = a[:i]
+		}
+		for _, m := range fieldRef.FindAllStringSubmatch(a, -1) {
+			if _, ok := vars[m[1]]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refersTo tells whether the template node n uses any of vars.
+func refersTo(n parse.Node, vars map[string]string) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if refersTo(c, vars) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return refersTo(n.Pipe, vars)
+	case *parse.IfNode:
+		return refersTo(n.Pipe, vars) || refersTo(n.List, vars) || refersTo(n.ElseList, vars)
+	case *parse.RangeNode:
+		return refersTo(n.Pipe, vars) || refersTo(n.List, vars) || refersTo(n.ElseList, vars)
+	case *parse.WithNode:
+		return refersTo(n.Pipe, vars) || refersTo(n.List, vars) || refersTo(n.ElseList, vars)
+	case *parse.TemplateNode:
+		return refersTo(n.Pipe, vars)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if refersTo(c, vars) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if refersTo(a, vars) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return refersTo(n.Node, vars)
+	case *parse.FieldNode:
+		_, ok := vars[n.Ident[0]]
+		return ok
+	}
+	return false
+}
+
+// resolveEnv returns s with its references to the environment resolved. If
+// quote is set, s is a template executed later and the values are quoted so
+// that they are taken as they are too.
+func (f *functionsMeta) resolveEnv(s string, quote bool) string {
+	return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		v, ok := os.LookupEnv(ref[2 : len(ref)-1])
+		if !ok {
+			return ref
+		}
+		if quote {
+			v = strings.Replace(v, "{{", `{{"{{"}}`, -1)
+		}
+		return v
+	})
+}
+
+// expandEnv returns a copy of the variables env with their values expanded.
+func expandEnv(env map[string]string, expand func(field, s string) string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	m := make(map[string]string, len(env))
+	for k, v := range env {
+		m[k] = expand("env "+k, v)
+	}
+	return m
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Jordi Carrillo. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("PAREXEC_TEST_ENV", "from env")
+	os.Setenv("PAREXEC_TEST_TEMPLATE", "{{.cluster}}")
+	os.Unsetenv("PAREXEC_TEST_UNSET")
+	defer os.Unsetenv("PAREXEC_TEST_ENV")
+	defer os.Unsetenv("PAREXEC_TEST_TEMPLATE")
+	tests := []struct {
+		name string
+		fn   functionMeta
+		// want is the function once interpolated, only its command,
+		// arguments and script are compared.
+		want functionMeta
+		err  string
+	}{
+		{
+			name: "vars and environment",
+			fn:   functionMeta{Cmd: "kubectl", Args: []string{"--context", "{{.cluster}}", "${PAREXEC_TEST_ENV}"}},
+			want: functionMeta{Cmd: "kubectl", Args: []string{"--context", "prod", "from env"}},
+		},
+		{
+			name: "variables not set are left for the shell",
+			fn:   functionMeta{Cmd: "echo", Args: []string{"${PAREXEC_TEST_UNSET}"}},
+			want: functionMeta{Cmd: "echo", Args: []string{"${PAREXEC_TEST_UNSET}"}},
+		},
+		{
+			name: "templates without vars are left for the command",
+			fn:   functionMeta{Cmd: "docker", Args: []string{"inspect", "--format", "{{.State.Running}}", "{{json .}}"}},
+			want: functionMeta{Cmd: "docker", Args: []string{"inspect", "--format", "{{.State.Running}}", "{{json .}}"}},
+		},
+		{
+			name: "environment values are not templates",
+			fn:   functionMeta{Cmd: "echo", Args: []string{"${PAREXEC_TEST_TEMPLATE}"}},
+			want: functionMeta{Cmd: "echo", Args: []string{"{{.cluster}}"}},
+		},
+		{
+			name: "environment values are not templates of steps",
+			fn:   functionMeta{Cmd: "echo", Args: []string{"{{.steps.get.stdout}} ${PAREXEC_TEST_TEMPLATE}"}},
+			want: functionMeta{Cmd: "echo", Args: []string{`{{.steps.get.stdout}} {{"{{"}}.cluster}}`}},
+		},
+		{
+			name: "scripts keep their variables",
+			fn:   functionMeta{Script: `for USER in a b; do echo "${USER} {{.cluster}} ${PAREXEC_TEST_ENV}"; done`},
+			want: functionMeta{Script: `for USER in a b; do echo "${USER} prod ${PAREXEC_TEST_ENV}"; done`},
+		},
+		{
+			name: "undefined var along with a defined one",
+			fn:   functionMeta{Cmd: "echo", Args: []string{"{{.cluster}} {{.clustr}}"}},
+			err:  `map has no entry for key "clustr"`,
+		},
+		{
+			name: "invalid template",
+			fn:   functionMeta{Cmd: "echo", Args: []string{"{{.cluster"}},
+			err:  "unclosed action",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &functionsMeta{
+				Vars: map[string]string{"cluster": "prod"},
+				Ex:   []execdataMeta{{Name: "b", Funcs: []functionMeta{tt.fn}}},
+			}
+			err := f.interpolate()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("interpolate() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := f.Ex[0].Funcs[0]
+			if got.Cmd != tt.want.Cmd || !reflect.DeepEqual(got.Args, tt.want.Args) || got.Script != tt.want.Script {
+				t.Errorf("interpolate() = %q %q %q, want %q %q %q", got.Cmd, got.Args, got.Script, tt.want.Cmd, tt.want.Args, tt.want.Script)
+			}
+		})
+	}
+}